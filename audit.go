@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// auditExcerptLength is the number of characters kept of a removed span
+const auditExcerptLength = 200
+
+// auditSpan is a piece of text removed while cleaning. Line and Offset refer
+// to the text as the stage received it.
+type auditSpan struct {
+	Stage   string `json:"stage"`
+	Rule    string `json:"rule,omitempty"`
+	Line    int    `json:"line"`
+	Lines   int    `json:"lines"`
+	Offset  int    `json:"offset"`
+	Length  int    `json:"length"`
+	Excerpt string `json:"excerpt"`
+}
+
+// cleanAudit records what the cleaning pipeline removed from a book. It is
+// written to <book>.audit.json, and with -audit html also as a side-by-side
+// diff to <book>.audit.html.
+type cleanAudit struct {
+	Book         string      `json:"book"`
+	Pipeline     string      `json:"pipeline"`
+	RawCharCount int         `json:"rawCharCount"`
+	CharCount    int         `json:"charCount"`
+	Stages       []stageStat `json:"stages"`
+	Removed      []auditSpan `json:"removed"`
+
+	stage  string
+	before string
+}
+
+// newCleanAudit starts the audit of a book. For the html diff the parser
+// output is kept with only whitespace and paragraphs resolved, so it lines up
+// with the cleaned text.
+func newCleanAudit(input string, config programConfig) *cleanAudit {
+	audit := &cleanAudit{
+		Pipeline:     pipelineString(config.pipeline),
+		RawCharCount: utf8.RuneCountInString(input),
+		Removed:      []auditSpan{},
+	}
+	if config.audit == "html" {
+		state := &cleanState{config: config}
+		before := paragraphsStage(normalizeStage(input, state), state)
+		audit.before = resolveMarks.Clean(before, state)
+	}
+	return audit
+}
+
+// add records a removed span of the current stage. text is the removed text,
+// found at offset and line of the stage input.
+func (audit *cleanAudit) add(rule string, line int, offset int, text string) {
+	if audit == nil {
+		return
+	}
+	excerpt := auditExcerpt(text)
+	if excerpt == "" {
+		return
+	}
+	audit.Removed = append(audit.Removed, auditSpan{
+		Stage:   audit.stage,
+		Rule:    rule,
+		Line:    line,
+		Lines:   strings.Count(text, "\n") + 1,
+		Offset:  offset,
+		Length:  len(text),
+		Excerpt: excerpt,
+	})
+}
+
+// addMarkedLines records the lines a rule marked for deletion. before is a
+// copy of the lines taken before the rule ran, offsets the position of each
+// line in the stage input. Runs of newly marked lines become one span.
+func (audit *cleanAudit) addMarkedLines(rule string, before []string, after []string, offsets []int) {
+	for i := 0; i < len(after); i++ {
+		if before[i] == "MARKED_FOR_DELETION" || after[i] != "MARKED_FOR_DELETION" {
+			continue
+		}
+		start := i
+		for i+1 < len(after) && before[i+1] != "MARKED_FOR_DELETION" && after[i+1] == "MARKED_FOR_DELETION" {
+			i++
+		}
+		audit.add(rule, start, offsets[start], strings.Join(before[start:i+1], "\n"))
+	}
+}
+
+// auditExcerpt shortens removed text for the report, with the parser marks
+// and runs of whitespace replaced by single spaces.
+func auditExcerpt(text string) string {
+	for _, mark := range []string{"PARAGRAPH", "HEADER!", "CHAPTER_SEPERATOR", "MARKED_FOR_DELETION"} {
+		text = strings.ReplaceAll(text, mark, " ")
+	}
+	text = strings.Join(strings.Fields(text), " ")
+	if utf8.RuneCountInString(text) > auditExcerptLength {
+		text = string([]rune(text)[:auditExcerptLength]) + "…"
+	}
+	return text
+}
+
+// lineOffsets returns the byte offset of each line.
+func lineOffsets(lines []string) []int {
+	offsets := make([]int, len(lines))
+	offset := 0
+	for i, line := range lines {
+		offsets[i] = offset
+		offset += len(line) + 1
+	}
+	return offsets
+}
+
+// writeAudit writes the audit of a book next to its output file and returns
+// the paths written.
+func writeAudit(result *bookResult, outputFilePath string, config programConfig) ([]string, error) {
+	audit := result.audit
+	audit.Book = result.meta.filename
+	audit.CharCount = utf8.RuneCountInString(result.text)
+	audit.Stages = result.stages
+
+	base := strings.TrimSuffix(outputFilePath, outputExtension(config))
+	out, err := json.MarshalIndent(audit, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	written := []string{base + ".audit.json"}
+	if err := os.WriteFile(written[0], out, 0644); err != nil {
+		return nil, err
+	}
+
+	if config.audit == "html" {
+		written = append(written, base+".audit.html")
+		if err := os.WriteFile(written[1], []byte(renderAuditHTML(audit, result.text)), 0644); err != nil {
+			return nil, err
+		}
+	}
+	return written, nil
+}
+
+// auditRow is one row of the side-by-side diff
+type auditRow struct {
+	left, right string
+}
+
+// diffParagraphs lines up the paragraphs before and after cleaning. Cleaning
+// mostly removes paragraphs, so every cleaned paragraph is matched with its
+// next occurrence in the original. Short paragraphs like "CHAPTER I" are only
+// matched nearby, so they don't pull the alignment far ahead.
+func diffParagraphs(before []string, after []string) []auditRow {
+	positions := make(map[string][]int)
+	for i, paragraph := range before {
+		positions[paragraph] = append(positions[paragraph], i)
+	}
+
+	rows := []auditRow{}
+	cursor := 0
+	for _, paragraph := range after {
+		match := -1
+		for _, p := range positions[paragraph] {
+			if p >= cursor {
+				match = p
+				break
+			}
+		}
+		if match >= 0 && match-cursor > 50 && utf8.RuneCountInString(paragraph) < 40 {
+			match = -1
+		}
+		if match < 0 {
+			rows = append(rows, auditRow{right: paragraph})
+			continue
+		}
+		for ; cursor < match; cursor++ {
+			rows = append(rows, auditRow{left: before[cursor]})
+		}
+		rows = append(rows, auditRow{left: paragraph, right: paragraph})
+		cursor++
+	}
+	for ; cursor < len(before); cursor++ {
+		rows = append(rows, auditRow{left: before[cursor]})
+	}
+	return rows
+}
+
+// nonEmptyLines splits text into lines, leaving out blank ones.
+func nonEmptyLines(text string) []string {
+	lines := []string{}
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// renderAuditHTML renders the side-by-side diff of a book. Long runs of
+// unchanged paragraphs are collapsed.
+func renderAuditHTML(audit *cleanAudit, cleaned string) string {
+	rows := diffParagraphs(nonEmptyLines(audit.before), nonEmptyLines(cleaned))
+
+	var sb strings.Builder
+	sb.WriteString("<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\">\n")
+	sb.WriteString("<title>Cleaning audit: " + html.EscapeString(audit.Book) + "</title>\n")
+	sb.WriteString("<style>body{font-family:sans-serif}table{border-collapse:collapse;width:100%;table-layout:fixed}" +
+		"td{vertical-align:top;padding:2px 6px;border-bottom:1px solid #eee;white-space:pre-wrap;word-wrap:break-word}" +
+		".del{background:#fdd}.ins{background:#dfd}.skip{color:#888;text-align:center;font-style:italic}</style>\n")
+	sb.WriteString("</head><body>\n")
+	sb.WriteString(fmt.Sprintf("<h1>%s</h1>\n<p>Pipeline: %s. %d of %d characters removed.</p>\n",
+		html.EscapeString(audit.Book), html.EscapeString(audit.Pipeline), audit.RawCharCount-audit.CharCount, audit.RawCharCount))
+	sb.WriteString("<table>\n<tr><th>Before</th><th>After</th></tr>\n")
+
+	writeRow := func(row auditRow) {
+		leftClass, rightClass := "", ""
+		if row.right == "" {
+			leftClass = " class=\"del\""
+		} else if row.left == "" {
+			rightClass = " class=\"ins\""
+		}
+		sb.WriteString(fmt.Sprintf("<tr><td%s>%s</td><td%s>%s</td></tr>\n",
+			leftClass, html.EscapeString(row.left), rightClass, html.EscapeString(row.right)))
+	}
+	for i := 0; i < len(rows); {
+		if rows[i].left == "" || rows[i].right == "" {
+			writeRow(rows[i])
+			i++
+			continue
+		}
+		end := i
+		for end < len(rows) && rows[end].left != "" && rows[end].right != "" {
+			end++
+		}
+		if end-i <= 6 {
+			for ; i < end; i++ {
+				writeRow(rows[i])
+			}
+			continue
+		}
+		writeRow(rows[i])
+		writeRow(rows[i+1])
+		sb.WriteString(fmt.Sprintf("<tr><td colspan=\"2\" class=\"skip\">%d unchanged paragraphs</td></tr>\n", end-i-4))
+		writeRow(rows[end-2])
+		writeRow(rows[end-1])
+		i = end
+	}
+	sb.WriteString("</table>\n</body></html>\n")
+	return sb.String()
+}
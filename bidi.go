@@ -0,0 +1,161 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Ways to treat bidi controls and dir attributes, see -bidi
+const (
+	bidiPreserve  = "preserve"
+	bidiNormalize = "normalize"
+)
+
+// The bidi controls written for dir attributes. Inline elements are isolated
+// from the text around them, bdo overrides the direction of its text and
+// blocks start with a mark, as isolates can't span lines.
+const (
+	bidiLRM = "\u200e"
+	bidiRLM = "\u200f"
+	bidiLRO = "\u202d"
+	bidiRLO = "\u202e"
+	bidiPDF = "\u202c"
+	bidiLRI = "\u2066"
+	bidiRLI = "\u2067"
+	bidiFSI = "\u2068"
+	bidiPDI = "\u2069"
+)
+
+// blockElements start a new line of text, so their direction is the
+// direction of a paragraph
+var blockElements = map[atom.Atom]bool{
+	atom.Html: true, atom.Body: true, atom.Div: true, atom.P: true, atom.Section: true,
+	atom.Article: true, atom.Header: true, atom.Footer: true, atom.Aside: true, atom.Nav: true,
+	atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	atom.Blockquote: true, atom.Pre: true, atom.Address: true, atom.Figure: true, atom.Figcaption: true,
+	atom.Ul: true, atom.Ol: true, atom.Li: true, atom.Dl: true, atom.Dt: true, atom.Dd: true,
+	atom.Table: true, atom.Tr: true, atom.Td: true, atom.Th: true, atom.Caption: true,
+}
+
+// isBidiControl reports whether r is a bidi control: the marks, embeddings,
+// overrides and isolates.
+func isBidiControl(r rune) bool {
+	return unicode.Is(unicode.Bidi_Control, r)
+}
+
+// stripBidiControls removes the bidi controls from text. Text in books is
+// stored in logical order, so this only loses how it is displayed.
+func stripBidiControls(text string) string {
+	if strings.IndexFunc(text, isBidiControl) < 0 {
+		return text
+	}
+	return strings.Map(func(r rune) rune {
+		if isBidiControl(r) {
+			return -1
+		}
+		return r
+	}, text)
+}
+
+// elementDir returns the dir attribute of an element when it is valid, or "".
+func elementDir(token html.Token) string {
+	switch dir := strings.ToLower(strings.TrimSpace(attrValue(token, "dir"))); dir {
+	case "ltr", "rtl", "auto":
+		return dir
+	}
+	return ""
+}
+
+// dirEntry is the direction of an open element and the control closing it
+type dirEntry struct {
+	dir   string
+	close string
+}
+
+// startDir follows the dir attribute of an element that starts. The first
+// dir of the html or body element of a document sets the direction of the
+// book when the spine doesn't. An inline element with a dir is isolated, a
+// block with a direction different from the book starts with a mark, written
+// before its first text. It runs after handleStartTag, so the mark follows
+// the paragraph mark of its element.
+func (p *parser) startDir(token html.Token) {
+	element := elementAtom(token)
+	dir := elementDir(token)
+	entry := dirEntry{dir: dir}
+	if dir == "" && len(p.dirStack) > 0 {
+		entry.dir = p.dirStack[len(p.dirStack)-1].dir
+	}
+	if (element == atom.Html || element == atom.Body) && dir != "" && dir != "auto" &&
+		p.opts.direction != nil && *p.opts.direction == "" {
+		*p.opts.direction = dir
+	}
+
+	if p.opts.bidi == bidiPreserve {
+		switch {
+		case element == atom.Bdo && dir == "rtl":
+			p.sb.WriteString(bidiRLO)
+			entry.close = bidiPDF
+		case element == atom.Bdo && dir == "ltr":
+			p.sb.WriteString(bidiLRO)
+			entry.close = bidiPDF
+		case element == atom.Bdi || (dir != "" && !blockElements[element]):
+			switch dir {
+			case "ltr":
+				p.sb.WriteString(bidiLRI)
+			case "rtl":
+				p.sb.WriteString(bidiRLI)
+			default:
+				//bdi and dir="auto" take the direction of their text
+				p.sb.WriteString(bidiFSI)
+			}
+			entry.close = bidiPDI
+		case blockElements[element] && element != atom.Html && element != atom.Body:
+			p.dirMark = ""
+			switch {
+			case entry.dir == "rtl" && p.bookDirection() != "rtl":
+				p.dirMark = bidiRLM
+			case entry.dir == "ltr" && p.bookDirection() != "ltr":
+				p.dirMark = bidiLRM
+			}
+		}
+	}
+	p.dirStack = append(p.dirStack, entry)
+}
+
+// bookDirection returns the direction of the book, ltr when it isn't known.
+func (p *parser) bookDirection() string {
+	if p.opts.direction == nil || *p.opts.direction == "" {
+		return "ltr"
+	}
+	return *p.opts.direction
+}
+
+// endDir closes the isolate or override of an element that ends. The
+// control is written even inside a part left out, as its opening control
+// was written.
+func (p *parser) endDir() {
+	if len(p.dirStack) == 0 {
+		return
+	}
+	entry := p.dirStack[len(p.dirStack)-1]
+	p.dirStack = p.dirStack[:len(p.dirStack)-1]
+	p.sb.WriteString(entry.close)
+}
+
+// markDirection writes the pending mark of a block before its first text,
+// unless the text starts with a bidi control of its own.
+func (p *parser) markDirection(text string) string {
+	trimmed := strings.TrimLeftFunc(text, unicode.IsSpace)
+	if p.dirMark == "" || trimmed == "" {
+		return text
+	}
+	if first, _ := utf8.DecodeRuneInString(trimmed); !isBidiControl(first) {
+		text = p.dirMark + text
+	}
+	p.dirMark = ""
+	return text
+}
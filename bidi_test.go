@@ -0,0 +1,151 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// zipFixture zips the book in testdata/<name>, passing every file through
+// edit so tests can vary it.
+func zipFixture(t *testing.T, name string, edit func(path string, data []byte) []byte) *bytes.Reader {
+	t.Helper()
+	root := filepath.Join("testdata", name)
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	//mimetype goes first and uncompressed
+	paths := []string{"mimetype"}
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if rel, _ := filepath.Rel(root, p); rel != "mimetype" {
+			paths = append(paths, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range paths {
+		data, err := os.ReadFile(filepath.Join(root, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if edit != nil {
+			data = edit(p, data)
+		}
+		method := zip.Deflate
+		if p == "mimetype" {
+			method = zip.Store
+		}
+		f, err := w.CreateHeader(&zip.FileHeader{Name: p, Method: method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(data)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+// convertFixture converts a fixture book with the given options.
+func convertFixture(t *testing.T, book *bytes.Reader, args ...string) *bookResult {
+	t.Helper()
+	logOutput = io.Discard
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := registerConfigFlags(fs)
+	args = append([]string{"-silent", "-minChars", "0", "-minParagraphLength", "0", "-maxSymbolRatio", "1"}, args...)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	config, err := flags.config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := convertEpub(book, book.Size(), "rtl.epub", config, &programCounter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.skipReason != "" {
+		t.Fatalf("book skipped: %s", result.skipReason)
+	}
+	return result
+}
+
+func TestBidiPreserve(t *testing.T) {
+	result := convertFixture(t, zipFixture(t, "rtl", nil), "-bidi", "preserve")
+	if result.meta.direction != "rtl" {
+		t.Errorf("direction = %q, want rtl", result.meta.direction)
+	}
+	for _, want := range []string{
+		//text stays in logical order, the order it was written in
+		"שלום עולם, זהו ספר בעברית עם ",
+		"مرحبا بالعالم، هذا فصل باللغة العربية.",
+		//an inline dir is isolated
+		bidiLRI + "Latin text 123" + bidiPDI,
+		//a block with a direction different from the book starts with a mark
+		bidiLRM + "An English paragraph",
+		bidiFSI + "שם" + bidiPDI,
+		bidiRLO + "abc" + bidiPDF,
+		//controls of the book are kept
+		"בתוכה." + bidiRLM,
+	} {
+		if !strings.Contains(result.text, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, result.text)
+		}
+	}
+}
+
+func TestBidiNormalize(t *testing.T) {
+	result := convertFixture(t, zipFixture(t, "rtl", nil), "-bidi", "normalize")
+	if i := strings.IndexFunc(result.text, isBidiControl); i >= 0 {
+		t.Errorf("output has a bidi control at %d:\n%q", i, result.text)
+	}
+	for _, want := range []string{
+		"שלום עולם, זהו ספר בעברית עם Latin text 123 בתוך המשפט.",
+		"with שם and abc in it.",
+		"مرحبا بالعالم، هذا فصل باللغة العربية.",
+	} {
+		if !strings.Contains(result.text, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, result.text)
+		}
+	}
+	if result.meta.direction != "rtl" {
+		t.Errorf("direction = %q, want rtl", result.meta.direction)
+	}
+}
+
+func TestBidiDirection(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(path string, data []byte) []byte
+		want string
+	}{
+		{"spine", func(path string, data []byte) []byte {
+			return bytes.ReplaceAll(data, []byte(" dir=\"rtl\">\n<head>"), []byte(">\n<head>"))
+		}, "rtl"},
+		{"html", func(path string, data []byte) []byte {
+			return bytes.ReplaceAll(data, []byte(` page-progression-direction="rtl"`), nil)
+		}, "rtl"},
+		{"none", func(path string, data []byte) []byte {
+			data = bytes.ReplaceAll(data, []byte(` page-progression-direction="rtl"`), nil)
+			return bytes.ReplaceAll(data, []byte(" dir=\"rtl\">\n<head>"), []byte(">\n<head>"))
+		}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := convertFixture(t, zipFixture(t, "rtl", test.edit))
+			if result.meta.direction != test.want {
+				t.Errorf("direction = %q, want %q", result.meta.direction, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// chunkRecord is one training window of a book
+type chunkRecord struct {
+	ID           string `json:"id"`
+	Book         string `json:"book"`
+	Title        string `json:"title"`
+	Author       string `json:"author"`
+	Chapter      int    `json:"chapter"`
+	ChapterTitle string `json:"chapterTitle"`
+	Chunk        int    `json:"chunk"`
+	Size         int    `json:"size"`
+	Text         string `json:"text"`
+}
+
+// chunkSegment is the smallest piece of text a chunk is built from. A segment
+// is a whole paragraph where possible, otherwise a sentence or a run of words.
+type chunkSegment struct {
+	text           string
+	size           int
+	paragraphStart bool
+}
+
+// chunkBook splits a converted book into windows of config.chunkSize units.
+// Chunks never cross chapter boundaries and carry the chapter number of the
+// chapter header, as the text and json outputs do.
+func chunkBook(result *bookResult, config programConfig) []chunkRecord {
+	bookID := strings.TrimSuffix(result.meta.filename, ".epub")
+	chunks := []chunkRecord{}
+	for _, chapter := range splitChapters(result.text) {
+		for n, text := range chunkText(chapter.Text, config) {
+			chunks = append(chunks, chunkRecord{
+				ID:           fmt.Sprintf("%s-c%d-%d", bookID, chapter.Index, n),
+				Book:         result.meta.filename,
+				Title:        result.meta.title,
+				Author:       result.meta.author,
+				Chapter:      chapter.Index,
+				ChapterTitle: chapter.Title,
+				Chunk:        n,
+				Size:         measureChunk(text, config),
+				Text:         text,
+			})
+		}
+	}
+	return chunks
+}
+
+// chunkText packs the segments of a chapter greedily into chunks, repeating
+// up to config.chunkOverlap units of whole segments at the start of the next
+// chunk.
+func chunkText(text string, config programConfig) []string {
+	segments := chunkSegments(text, config)
+	chunks := []string{}
+	current := []chunkSegment{}
+	size := 0
+	for _, segment := range segments {
+		if size+segment.size > config.chunkSize && len(current) > 0 {
+			chunks = append(chunks, joinSegments(current))
+
+			//carry the tail of the chunk over as overlap
+			overlap := []chunkSegment{}
+			overlapSize := 0
+			for i := len(current) - 1; i >= 0; i-- {
+				if overlapSize+current[i].size > config.chunkOverlap {
+					break
+				}
+				overlap = append([]chunkSegment{current[i]}, overlap...)
+				overlapSize += current[i].size
+			}
+			for len(overlap) > 0 && overlapSize+segment.size > config.chunkSize {
+				overlapSize -= overlap[0].size
+				overlap = overlap[1:]
+			}
+			current, size = overlap, overlapSize
+		}
+		current = append(current, segment)
+		size += segment.size
+	}
+	if len(current) > 0 {
+		chunks = append(chunks, joinSegments(current))
+	}
+	return chunks
+}
+
+// chunkSegments breaks a chapter into paragraphs, and paragraphs that are
+// larger than a chunk into sentences and then words.
+func chunkSegments(text string, config programConfig) []chunkSegment {
+	segments := []chunkSegment{}
+	for _, paragraph := range strings.Split(text, "\n") {
+		paragraph = strings.TrimSpace(paragraph)
+		if paragraph == "" {
+			continue
+		}
+		if size := measureChunk(paragraph, config); size <= config.chunkSize {
+			segments = append(segments, chunkSegment{text: paragraph, size: size, paragraphStart: true})
+			continue
+		}
+
+		start := true
+		for _, sentence := range segmentSentences(paragraph) {
+			if size := measureChunk(sentence, config); size <= config.chunkSize {
+				segments = append(segments, chunkSegment{text: sentence, size: size, paragraphStart: start})
+				start = false
+				continue
+			}
+			//a sentence longer than a chunk is cut between words
+			words := strings.Fields(sentence)
+			for len(words) > 0 {
+				n, size := 1, measureChunk(words[0], config)
+				for n < len(words) {
+					next := measureChunk(" "+words[n], config)
+					if size+next > config.chunkSize {
+						break
+					}
+					n, size = n+1, size+next
+				}
+				piece := strings.Join(words[:n], " ")
+				segments = append(segments, chunkSegment{text: piece, size: size, paragraphStart: start})
+				start = false
+				words = words[n:]
+			}
+		}
+	}
+	return segments
+}
+
+// joinSegments puts segments back together, keeping paragraph breaks.
+func joinSegments(segments []chunkSegment) string {
+	var sb strings.Builder
+	for i, segment := range segments {
+		if i > 0 {
+			if segment.paragraphStart {
+				sb.WriteString("\n")
+			} else {
+				sb.WriteString(" ")
+			}
+		}
+		sb.WriteString(segment.text)
+	}
+	return sb.String()
+}
+
+// measureChunk returns the size of text in the configured chunk unit.
+func measureChunk(text string, config programConfig) int {
+	switch config.chunkUnit {
+	case "chars":
+		return utf8.RuneCountInString(text)
+	case "tokens":
+		return config.tokenizer.count(text)
+	}
+	return len(strings.Fields(text))
+}
+
+// renderChunks encodes the chunks of a book as json lines.
+func renderChunks(result *bookResult, config programConfig) []byte {
+	out := []byte{}
+	for _, chunk := range chunkBook(result, config) {
+		out = appendJSONLine(out, chunk)
+	}
+	return out
+}
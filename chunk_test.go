@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestChunkBookChapters(t *testing.T) {
+	result := &bookResult{
+		meta: &metadata{filename: "book.epub", title: "Book"},
+		text: "A preamble before the first chapter.\n" +
+			"***\n[ Chapter 3: The Third ; ]\nThe third chapter.\n" +
+			"***\n[ Chapter 4: The Fourth ; ]\nThe fourth chapter.\n",
+	}
+	config := programConfig{chunkSize: 1000, chunkUnit: "chars"}
+	want := []struct {
+		id      string
+		chapter int
+		title   string
+	}{
+		{"book-c0-0", 0, ""},
+		{"book-c3-0", 3, "The Third"},
+		{"book-c4-0", 4, "The Fourth"},
+	}
+
+	chunks := chunkBook(result, config)
+	if len(chunks) != len(want) {
+		t.Fatalf("got %d chunks, want %d: %+v", len(chunks), len(want), chunks)
+	}
+	for i, chunk := range chunks {
+		if chunk.ID != want[i].id || chunk.Chapter != want[i].chapter || chunk.ChapterTitle != want[i].title {
+			t.Errorf("chunk %d = %s, chapter %d %q, want %s, chapter %d %q", i,
+				chunk.ID, chunk.Chapter, chunk.ChapterTitle, want[i].id, want[i].chapter, want[i].title)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/atom"
+)
+
+// Ways to treat ruby annotations like furigana, see -ruby
+const (
+	rubyDrop     = "drop"
+	rubyParen    = "paren"
+	rubySeparate = "separate"
+)
+
+// rubyPolicy returns the element policies of the ruby mode. drop is the
+// default table, which leaves out both the annotation and the <rp> fallback
+// parentheses. paren writes its own parentheses around the annotation.
+func rubyPolicy(mode string) map[atom.Atom]string {
+	switch mode {
+	case rubyParen:
+		return map[atom.Atom]string{atom.Rt: elementEmit}
+	case rubySeparate:
+		return map[atom.Atom]string{atom.Rt: elementSide}
+	}
+	return nil
+}
+
+// startRuby follows the start of ruby elements. The text since the start of
+// the ruby, or since the last annotation, is the base text of the next
+// annotation.
+func (p *parser) startRuby(element atom.Atom) {
+	switch element {
+	case atom.Ruby:
+		p.rubyStart = p.sb.Len()
+	case atom.Rt:
+		switch policy, _ := p.textPolicy(); policy {
+		case elementEmit:
+			if p.opts.ruby == rubyParen {
+				p.sb.WriteString("(")
+			}
+		case elementSide:
+			//the base goes with its annotation
+			if p.inElement(atom.Ruby) {
+				base := strings.TrimSpace(p.sb.String()[p.rubyStart:])
+				p.side = append(p.side, sideText{Element: "ruby", Text: base})
+				p.sideDepth = len(p.tagStack) - 1
+			}
+		}
+	}
+}
+
+// inElement reports whether the parser is inside an element.
+func (p *parser) inElement(element atom.Atom) bool {
+	for _, open := range p.tagStack {
+		if open == element {
+			return true
+		}
+	}
+	return false
+}
+
+// endRuby follows the end of ruby elements.
+func (p *parser) endRuby(element atom.Atom) {
+	if element != atom.Rt {
+		return
+	}
+	if policy, _ := p.textPolicy(); policy == elementEmit && p.opts.ruby == rubyParen {
+		p.sb.WriteString(")")
+	}
+	p.rubyStart = p.sb.Len()
+}
+
+// isCJK reports whether r is a Chinese or Japanese character or punctuation
+// mark, which are written without spaces between them.
+func isCJK(r rune) bool {
+	return isIdeograph(r) || (r >= 0x3000 && r <= 0x303f) || (r >= 0xff00 && r <= 0xffef)
+}
+
+// joinLines joins lines with spaces, except between lines that end and start
+// with Chinese or Japanese characters, where a line break is no word break.
+func joinLines(lines []string) string {
+	var sb strings.Builder
+	for i, line := range lines {
+		if i > 0 {
+			if cjkLineBreak(lines[i-1], line) {
+				line = strings.TrimLeftFunc(line, unicode.IsSpace)
+			} else {
+				sb.WriteString(" ")
+			}
+		}
+		if i+1 < len(lines) && cjkLineBreak(line, lines[i+1]) {
+			line = strings.TrimRightFunc(line, unicode.IsSpace)
+		}
+		sb.WriteString(line)
+	}
+	return sb.String()
+}
+
+// cjkLineBreak reports whether the break between line and next falls
+// between Chinese or Japanese characters.
+func cjkLineBreak(line string, next string) bool {
+	last, _ := utf8.DecodeLastRuneInString(strings.TrimRightFunc(line, unicode.IsSpace))
+	first, _ := utf8.DecodeRuneInString(strings.TrimLeftFunc(next, unicode.IsSpace))
+	return isCJK(last) && isCJK(first)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// runConvertCommand handles `convert <file.epub|->`. It converts a single book
+// and writes the result to stdout, reading the epub from stdin when the file
+// is "-". Progress messages go to stderr so the output can be piped.
+func runConvertCommand(args []string) {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s convert [options] <file.epub|->\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	flags := registerConfigFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	logOutput = os.Stderr
+	config, err := flags.config()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(2)
+	}
+	//only the book goes to stdout, there is nowhere to write reports
+	if config.audit != "off" {
+		fmt.Fprintln(os.Stderr, "Error: audit writes files next to the output and can't be used with convert")
+		os.Exit(2)
+	}
+	if config.dedup != nil {
+		fmt.Fprintln(os.Stderr, "Error: dedup compares the books of a run and can't be used with convert")
+		os.Exit(2)
+	}
+	counters := programCounter{timeStart: time.Now(), bookCount: 1}
+
+	//epubs are zip files, which need random access, so stdin is read into memory
+	var data []byte
+	name := fs.Arg(0)
+	if name == "-" {
+		data, err = io.ReadAll(os.Stdin)
+		name = "stdin.epub"
+	} else {
+		data, err = os.ReadFile(name)
+		name = filepath.Base(name)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading input:", err)
+		os.Exit(1)
+	}
+
+	result, err := convertEpub(bytes.NewReader(data), int64(len(data)), name, config, &counters)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+	//skipped books produce no output, the exit status tells pipelines why
+	if result.skipReason != "" {
+		fmt.Fprintf(os.Stderr, "Skipped %s: %s\n", name, result.skipReason)
+		os.Exit(3)
+	}
+
+	if _, err := os.Stdout.Write(renderBook(result, config)); err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing output:", err)
+		os.Exit(1)
+	}
+}
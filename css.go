@@ -0,0 +1,239 @@
+package main
+
+import (
+	"archive/zip"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// hiddenClasses hide text whatever the stylesheets say: screen reader only
+// text and Gutenberg's transcription helpers
+var hiddenClasses = map[string]bool{
+	"hidden": true, "sr-only": true, "visually-hidden": true, "screen-reader-text": true,
+}
+
+// Hints given by the classes of an element, see semanticClasses
+const (
+	hintChapter = "chapter"
+	hintVerse   = "verse"
+	hintBlock   = "block"
+	hintNotes   = "notes"
+)
+
+// semanticClasses are class names with a meaning for the structure of the
+// text. A chapter starts a new chapter, the lines of verse are kept, a block
+// is set apart from the text around it and notes are classed as the notes
+// matter, see -keepMatter.
+var semanticClasses = map[string]string{
+	"chapter":  hintChapter,
+	"poem":     hintVerse,
+	"verse":    hintVerse,
+	"letter":   hintBlock,
+	"footnote": hintNotes, "footnotes": hintNotes,
+}
+
+// styleSheet holds the visibility of the simple selectors of a stylesheet:
+// tag, .class, tag.class and #id. Other selectors are ignored.
+type styleSheet struct {
+	hidden map[string]bool
+}
+
+// parseStyleSheet reads the rules of a stylesheet that hide or show
+// elements. Rules inside @media and other at-rules are left out, most of them
+// are for print or small screens.
+func parseStyleSheet(css string) *styleSheet {
+	sheet := &styleSheet{hidden: make(map[string]bool)}
+	css = stripCSSComments(css)
+	for len(css) > 0 {
+		open := strings.IndexByte(css, '{')
+		if open < 0 {
+			break
+		}
+		selectors := strings.TrimSpace(css[:open])
+		if strings.HasPrefix(selectors, "@") {
+			if strings.Contains(selectors, ";") {
+				//@import and @charset end with a semicolon
+				css = css[strings.IndexByte(css, ';')+1:]
+				continue
+			}
+			css = css[skipCSSBlock(css, open):]
+			continue
+		}
+		end := strings.IndexByte(css[open:], '}')
+		if end < 0 {
+			break
+		}
+		hidden, ok := hidesElement(css[open+1 : open+end])
+		css = css[open+end+1:]
+		if !ok {
+			continue
+		}
+		for _, selector := range strings.Split(selectors, ",") {
+			if selector = strings.TrimSpace(selector); isSimpleSelector(selector) {
+				sheet.hidden[selector] = hidden
+			}
+		}
+	}
+	return sheet
+}
+
+// stripCSSComments removes /* comments */.
+func stripCSSComments(css string) string {
+	var sb strings.Builder
+	for {
+		start := strings.Index(css, "/*")
+		if start < 0 {
+			sb.WriteString(css)
+			return sb.String()
+		}
+		sb.WriteString(css[:start])
+		end := strings.Index(css[start+2:], "*/")
+		if end < 0 {
+			return sb.String()
+		}
+		css = css[start+2+end+2:]
+	}
+}
+
+// skipCSSBlock returns the position after the block opened at open, with the
+// blocks nested in it.
+func skipCSSBlock(css string, open int) int {
+	depth := 0
+	for i := open; i < len(css); i++ {
+		switch css[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return len(css)
+}
+
+// isSimpleSelector reports whether the selector is a tag, .class, tag.class
+// or #id, without combinators, attributes or pseudo-classes.
+func isSimpleSelector(selector string) bool {
+	if selector == "" || strings.Count(selector, ".") > 1 {
+		return false
+	}
+	return !strings.ContainsAny(selector, " >+~[]:*()") && (!strings.Contains(selector, "#") || strings.HasPrefix(selector, "#"))
+}
+
+// hidesElement reports whether the declarations hide the element, and
+// whether they say anything about its visibility at all. Besides display:none
+// and visibility:hidden this catches the usual ways to keep text for screen
+// readers only: clipping it away and moving it off the screen.
+func hidesElement(declarations string) (bool, bool) {
+	values := make(map[string]string)
+	for _, declaration := range strings.Split(declarations, ";") {
+		property, value, ok := strings.Cut(declaration, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), "!important"))
+		values[strings.ToLower(strings.TrimSpace(property))] = strings.ToLower(value)
+	}
+
+	display, hasDisplay := values["display"]
+	visibility, hasVisibility := values["visibility"]
+	switch {
+	case display == "none" || visibility == "hidden":
+		return true, true
+	case values["position"] == "absolute" &&
+		(strings.HasPrefix(values["clip"], "rect(0") || strings.HasPrefix(values["clip"], "rect(1px") ||
+			(cssLength(values["width"]) <= 1 && cssLength(values["height"]) <= 1) ||
+			cssLength(values["left"]) <= -999 || cssLength(values["top"]) <= -999):
+		return true, true
+	}
+	return false, hasDisplay || hasVisibility
+}
+
+// cssLength returns the number of a length like "1px", or 1000 when it has
+// none.
+func cssLength(value string) float64 {
+	value = strings.TrimRight(value, "abcdefghijklmnopqrstuvwxyz%")
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 1000
+	}
+	return n
+}
+
+// hides reports whether the stylesheet hides the element.
+func (sheet *styleSheet) hides(token html.Token) bool {
+	if sheet == nil || len(sheet.hidden) == 0 {
+		return false
+	}
+	if sheet.hidden[token.Data] {
+		return true
+	}
+	if id := attrValue(token, "id"); id != "" && sheet.hidden["#"+id] {
+		return true
+	}
+	for _, class := range strings.Fields(attrValue(token, "class")) {
+		if sheet.hidden["."+class] || sheet.hidden[token.Data+"."+class] {
+			return true
+		}
+	}
+	return false
+}
+
+// isHidden reports whether the element is hidden by its hidden attribute, its
+// style attribute, its classes or the stylesheets of the document.
+func isHidden(token html.Token, sheets []*styleSheet) bool {
+	for _, a := range token.Attr {
+		switch a.Key {
+		case "hidden":
+			return true
+		case "style":
+			if hidden, _ := hidesElement(a.Val); hidden {
+				return true
+			}
+		case "class":
+			for _, class := range strings.Fields(a.Val) {
+				if hiddenClasses[class] {
+					return true
+				}
+			}
+		}
+	}
+	for _, sheet := range sheets {
+		if sheet.hides(token) {
+			return true
+		}
+	}
+	return false
+}
+
+// elementHint returns the hint given by the classes of the element, or "".
+func elementHint(token html.Token) string {
+	for _, class := range strings.Fields(attrValue(token, "class")) {
+		if hint, ok := semanticClasses[class]; ok {
+			return hint
+		}
+	}
+	return ""
+}
+
+// loadStyleSheets parses the stylesheets in the manifest of a book, by path
+// in the archive. Stylesheets that can't be read are left out.
+func loadStyleSheets(z *zip.Reader, opfPath string, pkg *opfPackage) map[string]*styleSheet {
+	sheets := make(map[string]*styleSheet)
+	for _, item := range pkg.Items {
+		if item.MediaType != "text/css" {
+			continue
+		}
+		sheetPath, _ := resolveHREF(opfPath, item.HREF)
+		data, err := readZipFile(z, sheetPath)
+		if err != nil {
+			continue
+		}
+		sheets[sheetPath] = parseStyleSheet(string(data))
+	}
+	return sheets
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// minhashSize is the number of hash functions in a MinHash signature
+	minhashSize = 128
+	// lshBands splits the signature into bands of minhashSize/lshBands rows.
+	// Books sharing any band are compared, which finds pairs down to a
+	// Jaccard similarity of roughly 0.4.
+	lshBands = 32
+	// shingleSize is the number of words in a shingle
+	shingleSize = 5
+)
+
+// minhashSeeds are the per-function seeds used to derive the hash family
+var minhashSeeds = func() [minhashSize]uint64 {
+	var seeds [minhashSize]uint64
+	state := uint64(0x5eed)
+	for i := range seeds {
+		state += 0x9e3779b97f4a7c15
+		seeds[i] = mix64(state)
+	}
+	return seeds
+}()
+
+// dedupBook is a converted book as seen by the deduplication index
+type dedupBook struct {
+	source    string
+	title     string
+	author    string
+	charCount int
+	hash      string
+	signature [minhashSize]uint32
+	parent    int
+	skipped   bool
+	removed   bool
+}
+
+// dedupIndex finds exact and near-duplicate books across a run. Exact
+// duplicates share the hash of their normalized text, near-duplicates are
+// found with MinHash signatures and locality sensitive hashing.
+type dedupIndex struct {
+	mode      string
+	threshold float64
+
+	mu      sync.Mutex
+	books   []*dedupBook
+	hashes  map[string]int
+	buckets map[uint64][]int
+}
+
+// dedupMember is a book in a dedupCluster
+type dedupMember struct {
+	File       string  `json:"file"`
+	Title      string  `json:"title"`
+	Author     string  `json:"author"`
+	CharCount  int     `json:"charCount"`
+	Exact      bool    `json:"exact"`
+	Similarity float64 `json:"similarity"`
+	Skipped    bool    `json:"skipped"`
+}
+
+// dedupCluster is a group of editions of the same work
+type dedupCluster struct {
+	Canonical string        `json:"canonical"`
+	Members   []dedupMember `json:"members"`
+}
+
+// dedupReport is written to the output directory after a run
+type dedupReport struct {
+	Mode      string         `json:"mode"`
+	Threshold float64        `json:"threshold"`
+	Books     int            `json:"books"`
+	Clusters  []dedupCluster `json:"clusters"`
+}
+
+func newDedupIndex(mode string, threshold float64) *dedupIndex {
+	return &dedupIndex{
+		mode:      mode,
+		threshold: threshold,
+		hashes:    make(map[string]int),
+		buckets:   make(map[uint64][]int),
+	}
+}
+
+// add records a book and returns the source of an earlier book it duplicates,
+// or "" when it is new. source is the path of the epub, which tells apart
+// books with the same file name in different folders. In skip mode duplicates are not indexed themselves,
+// so the first edition seen stays the one every later edition is compared to.
+func (d *dedupIndex) add(source string, meta *metadata, text string) string {
+	words := normalizedWords(text)
+	sum := sha256.Sum256([]byte(strings.Join(words, " ")))
+	book := &dedupBook{
+		source:    source,
+		title:     meta.title,
+		author:    meta.author,
+		charCount: utf8.RuneCountInString(text),
+		hash:      hex.EncodeToString(sum[:]),
+		signature: minhashSignature(words),
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	id := len(d.books)
+	book.parent = id
+	d.books = append(d.books, book)
+
+	match := -1
+	if other, ok := d.hashes[book.hash]; ok {
+		match = other
+	} else {
+		best := d.threshold
+		for _, other := range d.candidates(book) {
+			if sim := signatureSimilarity(&book.signature, &d.books[other].signature); sim >= best {
+				match, best = other, sim
+			}
+		}
+	}
+
+	if match >= 0 {
+		d.union(match, id)
+		if d.mode == "skip" {
+			book.skipped = true
+			return d.books[match].source
+		}
+	}
+
+	if _, ok := d.hashes[book.hash]; !ok {
+		d.hashes[book.hash] = id
+	}
+	for _, key := range bandKeys(&book.signature) {
+		d.buckets[key] = append(d.buckets[key], id)
+	}
+	if match >= 0 {
+		return d.books[match].source
+	}
+	return ""
+}
+
+// remove drops the books recorded for source from the index and the report.
+// In watch mode a book that changed is removed before it is converted again,
+// so it isn't compared to its own earlier version.
+func (d *dedupIndex) remove(source string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id, book := range d.books {
+		if book.source != source || book.removed {
+			continue
+		}
+		book.removed = true
+		if other, ok := d.hashes[book.hash]; ok && other == id {
+			delete(d.hashes, book.hash)
+			for other, b := range d.books {
+				if !b.removed && !b.skipped && b.hash == book.hash {
+					d.hashes[book.hash] = other
+					break
+				}
+			}
+		}
+		for _, key := range bandKeys(&book.signature) {
+			kept := d.buckets[key][:0]
+			for _, other := range d.buckets[key] {
+				if other != id {
+					kept = append(kept, other)
+				}
+			}
+			d.buckets[key] = kept
+		}
+		d.recluster(d.find(id))
+	}
+}
+
+// recluster links the books of the cluster with the given root again, leaving
+// out the removed ones, so the books that remain aren't held together by a
+// book that is gone. Each book is matched against the earlier ones as add
+// does.
+func (d *dedupIndex) recluster(root int) {
+	members := []int{}
+	for id := range d.books {
+		if d.find(id) == root {
+			members = append(members, id)
+		}
+	}
+	for _, id := range members {
+		d.books[id].parent = id
+	}
+
+	for i, id := range members {
+		book := d.books[id]
+		if book.removed {
+			continue
+		}
+		match, best := -1, d.threshold
+		for _, other := range members[:i] {
+			//skipped books are not indexed, so nothing was matched against them
+			if d.books[other].removed || d.books[other].skipped {
+				continue
+			}
+			if d.books[other].hash == book.hash {
+				match = other
+				break
+			}
+			if sim := signatureSimilarity(&book.signature, &d.books[other].signature); sim >= best {
+				match, best = other, sim
+			}
+		}
+		if match >= 0 {
+			d.union(match, id)
+		}
+	}
+}
+
+// candidates returns the indexed books that share at least one LSH band.
+func (d *dedupIndex) candidates(book *dedupBook) []int {
+	seen := make(map[int]bool)
+	found := []int{}
+	for _, key := range bandKeys(&book.signature) {
+		for _, other := range d.buckets[key] {
+			if !seen[other] {
+				seen[other] = true
+				found = append(found, other)
+			}
+		}
+	}
+	return found
+}
+
+func (d *dedupIndex) find(id int) int {
+	for d.books[id].parent != id {
+		d.books[id].parent = d.books[d.books[id].parent].parent
+		id = d.books[id].parent
+	}
+	return id
+}
+
+func (d *dedupIndex) union(a, b int) {
+	ra, rb := d.find(a), d.find(b)
+	if ra != rb {
+		d.books[rb].parent = ra
+	}
+}
+
+// report groups the duplicates into clusters. In report mode the canonical
+// edition is the longest one, as it is usually the most complete. In skip
+// mode it is the edition that was kept.
+func (d *dedupIndex) report() dedupReport {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	groups := make(map[int][]int)
+	books := 0
+	for id, book := range d.books {
+		if book.removed {
+			continue
+		}
+		root := d.find(id)
+		groups[root] = append(groups[root], id)
+		books++
+	}
+
+	report := dedupReport{Mode: d.mode, Threshold: d.threshold, Books: books, Clusters: []dedupCluster{}}
+	for _, ids := range groups {
+		if len(ids) < 2 {
+			continue
+		}
+		canonical := ids[0]
+		for _, id := range ids {
+			book := d.books[id]
+			if d.mode == "skip" && !book.skipped {
+				canonical = id
+				break
+			}
+			if d.mode != "skip" && book.charCount > d.books[canonical].charCount {
+				canonical = id
+			}
+		}
+
+		cluster := dedupCluster{Canonical: d.books[canonical].source}
+		for _, id := range ids {
+			book := d.books[id]
+			cluster.Members = append(cluster.Members, dedupMember{
+				File:       book.source,
+				Title:      book.title,
+				Author:     book.author,
+				CharCount:  book.charCount,
+				Exact:      book.hash == d.books[canonical].hash,
+				Similarity: signatureSimilarity(&book.signature, &d.books[canonical].signature),
+				Skipped:    book.skipped,
+			})
+		}
+		report.Clusters = append(report.Clusters, cluster)
+	}
+	sort.Slice(report.Clusters, func(i, j int) bool {
+		return report.Clusters[i].Canonical < report.Clusters[j].Canonical
+	})
+	return report
+}
+
+// writeReport writes the cluster report to dedup-report.json in outputdir.
+func (d *dedupIndex) writeReport(outputdir string) error {
+	out, err := json.MarshalIndent(d.report(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(outputdir, "dedup-report.json"), out, 0644)
+}
+
+// normalizedWords lowercases the text and splits it into words, leaving out
+// punctuation and the chapter headers added during cleaning, so editions that
+// only differ in formatting hash the same.
+func normalizedWords(text string) []string {
+	text = chapterHeaderRegex.ReplaceAllString(text, "")
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// minhashSignature computes the MinHash signature of the word shingles.
+func minhashSignature(words []string) [minhashSize]uint32 {
+	var signature [minhashSize]uint32
+	for i := range signature {
+		signature[i] = ^uint32(0)
+	}
+	if len(words) == 0 {
+		return signature
+	}
+
+	count := len(words) - shingleSize + 1
+	if count < 1 {
+		count = 1
+	}
+	h := fnv.New64a()
+	for i := 0; i < count; i++ {
+		end := i + shingleSize
+		if end > len(words) {
+			end = len(words)
+		}
+		h.Reset()
+		for _, word := range words[i:end] {
+			h.Write([]byte(word))
+			h.Write([]byte{' '})
+		}
+		shingle := h.Sum64()
+		for j, seed := range minhashSeeds {
+			if v := uint32(mix64(shingle ^ seed)); v < signature[j] {
+				signature[j] = v
+			}
+		}
+	}
+	return signature
+}
+
+// signatureSimilarity estimates the Jaccard similarity of two books.
+func signatureSimilarity(a, b *[minhashSize]uint32) float64 {
+	same := 0
+	for i := range a {
+		if a[i] == b[i] {
+			same++
+		}
+	}
+	return float64(same) / minhashSize
+}
+
+// bandKeys hashes each LSH band of a signature, including the band number so
+// equal values in different bands don't collide.
+func bandKeys(signature *[minhashSize]uint32) []uint64 {
+	rows := minhashSize / lshBands
+	keys := make([]uint64, lshBands)
+	for band := range keys {
+		key := uint64(band)
+		for _, v := range signature[band*rows : (band+1)*rows] {
+			key = mix64(key ^ uint64(v))
+		}
+		keys[band] = key
+	}
+	return keys
+}
+
+// mix64 is the splitmix64 finalizer
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// dedupText builds a text of distinct words, prefix<from> to prefix<to-1>.
+func dedupText(prefix string, from int, to int) string {
+	words := []string{}
+	for i := from; i < to; i++ {
+		words = append(words, fmt.Sprintf("%s%d", prefix, i))
+	}
+	return strings.Join(words, " ")
+}
+
+// dedupTexts are three books: B and C each share most of their text with A,
+// but only about 40% with each other
+var dedupTexts = map[string]string{
+	"a.epub": dedupText("w", 0, 100),
+	"b.epub": dedupText("w", 0, 80) + " " + dedupText("x", 0, 20),
+	"c.epub": dedupText("y", 0, 20) + " " + dedupText("w", 20, 100),
+}
+
+// dedupClusters lists the members of each cluster of the report.
+func dedupClusters(d *dedupIndex) [][]string {
+	clusters := [][]string{}
+	for _, cluster := range d.report().Clusters {
+		members := []string{}
+		for _, member := range cluster.Members {
+			members = append(members, member.File)
+		}
+		clusters = append(clusters, members)
+	}
+	return clusters
+}
+
+func TestDedupRemove(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []string
+		want  string
+	}{
+		{"re-added book", []string{"+a.epub", "+b.epub", "-a.epub", "+c.epub"}, "[]"},
+		{"removed link", []string{"+a.epub", "+b.epub", "+c.epub", "-a.epub"}, "[]"},
+		{"remaining match", []string{"+a.epub", "+b.epub", "-b.epub", "+c.epub"}, "[[a.epub c.epub]]"},
+		{"same path again", []string{"+a.epub", "+b.epub", "-a.epub", "+a.epub"}, "[[b.epub a.epub]]"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := newDedupIndex("report", 0.55)
+			for _, step := range test.steps {
+				source := step[1:]
+				if step[0] == '-' {
+					d.remove(source)
+					continue
+				}
+				d.add(source, &metadata{}, dedupTexts[source])
+			}
+			if got := fmt.Sprint(dedupClusters(d)); got != test.want {
+				t.Errorf("clusters = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Element policies, see defaultElementPolicy
+const (
+	elementEmit = "emit"
+	elementSkip = "skip"
+	elementSide = "side"
+)
+
+// defaultElementPolicy decides what happens to the text of elements that
+// aren't prose. emit writes it with the book, skip leaves it out and side
+// writes it to the side channel, see sideText. Text follows the innermost
+// element with a policy, so the title is kept although the rest of the head
+// is not, and only the annotations of math are skipped.
+var defaultElementPolicy = map[atom.Atom]string{
+	atom.Head:          elementSkip,
+	atom.Title:         elementEmit,
+	atom.Style:         elementSkip,
+	atom.Script:        elementSkip,
+	atom.Noscript:      elementSkip,
+	atom.Template:      elementSkip,
+	atom.Nav:           elementSkip,
+	atom.Svg:           elementSkip,
+	atom.Annotation:    elementSkip,
+	atom.AnnotationXml: elementSkip,
+	atom.Aside:         elementSide,
+	atom.Rt:            elementSkip,
+	atom.Rp:            elementSkip,
+}
+
+// sideText is the text of one element routed to the side channel
+type sideText struct {
+	Element string `json:"element"`
+	Text    string `json:"text"`
+}
+
+// parseElementPolicy applies the policies of the -ruby mode and then the
+// element=policy pairs of -elementPolicy to the default table.
+func parseElementPolicy(spec string, ruby string) (map[atom.Atom]string, error) {
+	policy := make(map[atom.Atom]string, len(defaultElementPolicy))
+	for element, p := range defaultElementPolicy {
+		policy[element] = p
+	}
+	for element, p := range rubyPolicy(ruby) {
+		policy[element] = p
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, p, ok := strings.Cut(pair, "=")
+		element := atom.Lookup([]byte(strings.ToLower(strings.TrimSpace(name))))
+		if !ok || element == 0 {
+			return nil, fmt.Errorf("elementPolicy entries must look like element=policy, with a known html element: %q", pair)
+		}
+		p = strings.TrimSpace(p)
+		if p != elementEmit && p != elementSkip && p != elementSide {
+			return nil, fmt.Errorf("elementPolicy for %s must be one of the following: emit, skip, side", name)
+		}
+		policy[element] = p
+	}
+	return policy, nil
+}
+
+// elementPolicyString formats a policy table for printing, leaving out the
+// entries that match the default.
+func elementPolicyString(policy map[atom.Atom]string) string {
+	entries := []string{}
+	for element, p := range policy {
+		if defaultElementPolicy[element] != p {
+			entries = append(entries, element.String()+"="+p)
+		}
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+// elementAtom returns the atom of an element, also for names with a namespace
+// prefix like m:math.
+func elementAtom(token html.Token) atom.Atom {
+	if token.DataAtom != 0 {
+		return token.DataAtom
+	}
+	if _, local, ok := strings.Cut(token.Data, ":"); ok {
+		return atom.Lookup([]byte(local))
+	}
+	return 0
+}
+
+// textPolicy returns the policy for text at the current position and the
+// depth of the element it comes from. Text outside any element with a policy
+// is emitted.
+func (p *parser) textPolicy() (string, int) {
+	for i := len(p.tagStack) - 1; i >= 0; i-- {
+		if policy, ok := p.opts.elementPolicy[p.tagStack[i]]; ok {
+			return policy, i
+		}
+	}
+	return elementEmit, -1
+}
+
+// addSideText routes text of the element at depth to the side channel. Text
+// of one element is kept together.
+func (p *parser) addSideText(text string, depth int) {
+	if strings.TrimSpace(text) == "" {
+		return
+	}
+	if p.sideDepth != depth || len(p.side) == 0 {
+		p.side = append(p.side, sideText{Element: p.tagStack[depth].String()})
+		p.sideDepth = depth
+	}
+	entry := &p.side[len(p.side)-1]
+	entry.Text = strings.Join(strings.Fields(entry.Text+" "+text), " ")
+}
+
+// endSideText closes the side channel entry when its element ends.
+func (p *parser) endSideText() {
+	if p.sideDepth == len(p.tagStack)-1 {
+		p.sideDepth = -1
+	}
+}
+
+// writeSideText writes the side channel of a book next to its output file and
+// returns the path written.
+func writeSideText(result *bookResult, outputFilePath string, config programConfig) (string, error) {
+	sidePath := strings.TrimSuffix(outputFilePath, outputExtension(config)) + ".side.txt"
+	var sb strings.Builder
+	for _, side := range result.side {
+		sb.WriteString("[ " + side.Element + " ] " + side.Text + "\n")
+	}
+	return sidePath, os.WriteFile(sidePath, []byte(sb.String()), 0644)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// xmlEncodingRegex finds the encoding declared by the XML prolog
+var xmlEncodingRegex = regexp.MustCompile(`^\s*<\?xml[^>]*\sencoding\s*=\s*["']([A-Za-z0-9._:-]+)["']`)
+
+// metaCharsetRegex finds the charset of <meta charset> or of the content of
+// <meta http-equiv="Content-Type">
+var metaCharsetRegex = regexp.MustCompile(`(?i)<meta\s[^>]*charset\s*=\s*["']?([A-Za-z0-9._:-]+)`)
+
+// documentEncoding returns the encoding a document declares with a byte order
+// mark, its XML prolog or a meta charset, in that order, or "".
+func documentEncoding(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xef, 0xbb, 0xbf}):
+		return "utf-8"
+	case bytes.HasPrefix(data, []byte{0xff, 0xfe}):
+		return "utf-16le"
+	case bytes.HasPrefix(data, []byte{0xfe, 0xff}):
+		return "utf-16be"
+	}
+	head := data
+	if len(head) > 1024 {
+		head = head[:1024]
+	}
+	if m := xmlEncodingRegex.FindSubmatch(head); m != nil {
+		return strings.ToLower(string(m[1]))
+	}
+	if m := metaCharsetRegex.FindSubmatch(head); m != nil {
+		return strings.ToLower(string(m[1]))
+	}
+	return ""
+}
+
+// decodeDocument transcodes a document of the spine to UTF-8, which is all the
+// tokenizer reads. It returns the text and the name of the encoding it was
+// transcoded from, or "" when it already was UTF-8. In a document that
+// declares UTF-8, or declares nothing, only the bytes that aren't valid UTF-8
+// are read as Windows-1252, the usual encoding of older books, so a stray
+// byte doesn't garble the rest of the document.
+func decodeDocument(data []byte) ([]byte, string) {
+	enc, name := charset.Lookup(documentEncoding(data))
+	if enc == nil || name == "utf-8" {
+		if utf8.Valid(data) {
+			return data, ""
+		}
+		return decodeInvalidBytes(data), "windows-1252"
+	}
+	decoded, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return data, ""
+	}
+	return bytes.TrimPrefix(decoded, []byte("\ufeff")), name
+}
+
+// decodeInvalidBytes keeps the valid UTF-8 of data and reads every byte that
+// isn't part of it as Windows-1252.
+func decodeInvalidBytes(data []byte) []byte {
+	decoded := make([]byte, 0, len(data)+len(data)/8)
+	for len(data) > 0 {
+		r, size := utf8.DecodeRune(data)
+		if r == utf8.RuneError && size == 1 {
+			decoded = utf8.AppendRune(decoded, charmap.Windows1252.DecodeByte(data[0]))
+		} else {
+			decoded = append(decoded, data[:size]...)
+		}
+		data = data[size:]
+	}
+	return bytes.TrimPrefix(decoded, []byte("\ufeff"))
+}
+
+// mojibakeBytes maps the characters that UTF-8 continuation bytes turn into
+// when read as Windows-1252 or Latin-1 back to the bytes
+var mojibakeBytes = func() map[rune]byte {
+	runes := make(map[rune]byte)
+	for b := 0x80; b <= 0xbf; b++ {
+		runes[charmap.Windows1252.DecodeByte(byte(b))] = byte(b)
+		runes[rune(b)] = byte(b)
+	}
+	return runes
+}()
+
+// mojibakeRegex matches UTF-8 read as Windows-1252 or Latin-1: runs of lead
+// bytes, U+00C2 to U+00F4, each followed by as many continuation bytes as
+// its sequence needs
+var mojibakeRegex = func() *regexp.Regexp {
+	var class strings.Builder
+	class.WriteString("[")
+	for r := range mojibakeBytes {
+		class.WriteString(regexp.QuoteMeta(string(r)))
+	}
+	class.WriteString("]")
+	c := class.String()
+	return regexp.MustCompile(`(?:[\x{c2}-\x{df}]` + c + `|[\x{e0}-\x{ef}]` + c + c + `|[\x{f0}-\x{f4}]` + c + c + c + `)+`)
+}()
+
+// repairMojibake decodes a match of mojibakeRegex. It only succeeds when the
+// bytes are valid UTF-8 of printable characters, and two byte sequences
+// decode to Latin, Greek or Cyrillic letters, so German text like "daß“",
+// which would decode to N'Ko, is left alone.
+func repairMojibake(match string) (string, bool) {
+	raw := make([]byte, 0, len(match))
+	for _, r := range match {
+		if r >= 0xc2 && r <= 0xf4 {
+			raw = append(raw, byte(r))
+		} else {
+			raw = append(raw, mojibakeBytes[r])
+		}
+	}
+	if !utf8.Valid(raw) {
+		return "", false
+	}
+	repaired := string(raw)
+	for _, r := range repaired {
+		if !unicode.IsGraphic(r) || r < 0xa0 || (utf8.RuneLen(r) == 2 && r > 0x52f) {
+			return "", false
+		}
+	}
+	return repaired, true
+}
+
+// mojibakeStage repairs text that was encoded as UTF-8 twice, like "â€™"
+// for an apostrophe or "Ã©" for "é". It runs before normalize, which would
+// turn the quotes of the mojibake into ASCII.
+func mojibakeStage(input string, state *cleanState) string {
+	var sb strings.Builder
+	last, line, counted := 0, 0, 0
+	for _, loc := range mojibakeRegex.FindAllStringIndex(input, -1) {
+		repaired, ok := repairMojibake(input[loc[0]:loc[1]])
+		if !ok {
+			continue
+		}
+		if state.audit != nil {
+			line += strings.Count(input[counted:loc[0]], "\n")
+			counted = loc[0]
+			state.audit.add("mojibake", line, loc[0], input[loc[0]:loc[1]])
+		}
+		sb.WriteString(input[last:loc[0]])
+		sb.WriteString(repaired)
+		last = loc[1]
+		state.repairs++
+	}
+	sb.WriteString(input[last:])
+	return sb.String()
+}
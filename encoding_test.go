@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestDecodeDocument(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		want     string
+		encoding string
+	}{
+		{"utf-8", "<p>café</p>", "<p>café</p>", ""},
+		{"stray byte", "<p>café \x93quoted\x94</p>", "<p>café “quoted”</p>", "windows-1252"},
+		{"undeclared windows-1252", "<p>caf\xe9 \x96 na\xefve</p>", "<p>café – naïve</p>", "windows-1252"},
+		{"declared latin-1", "<?xml version=\"1.0\" encoding=\"iso-8859-1\"?><p>caf\xe9</p>",
+			"<?xml version=\"1.0\" encoding=\"iso-8859-1\"?><p>café</p>", "windows-1252"},
+		{"byte order mark", "\xef\xbb\xbf<p>caf\xe9</p>", "<p>café</p>", "windows-1252"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, encoding := decodeDocument([]byte(test.data))
+			if string(got) != test.want || encoding != test.encoding {
+				t.Errorf("decodeDocument(%q) = %q, %q, want %q, %q", test.data, got, encoding, test.want, test.encoding)
+			}
+		})
+	}
+}
+
+func TestMojibakeStage(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"apostrophe", "It wasnâ€™t late.", "It wasn’t late."},
+		{"accent", "A cafÃ© in Paris.", "A café in Paris."},
+		{"dash", "Wait â€” stop.", "Wait — stop."},
+		//correct text that must be left alone
+		{"german", "Er sagte, daß“ es regnet.", "Er sagte, daß“ es regnet."},
+		{"french", "À la carte, Ça va, Ô mon Dieu, Être.", "À la carte, Ça va, Ô mon Dieu, Être."},
+		{"nordic", "Ångström and Øresund, Æsir.", "Ångström and Øresund, Æsir."},
+		{"capitals", "ÉCOLE, ÂME, ÎLE, ÜBER.", "ÉCOLE, ÂME, ÎLE, ÜBER."},
+		{"guillemets", "Â« non Â» is mojibake, « non » isn't.", "« non » is mojibake, « non » isn't."},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := mojibakeStage(test.text, &cleanState{}); got != test.want {
+				t.Errorf("mojibakeStage(%q) = %q, want %q", test.text, got, test.want)
+			}
+		})
+	}
+}
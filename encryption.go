@@ -0,0 +1,68 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"io/fs"
+)
+
+// encryptionPath is where a book lists its encrypted and obfuscated files
+const encryptionPath = "META-INF/encryption.xml"
+
+// fontObfuscation are the algorithms of the IDPF and Adobe font obfuscation.
+// They only scramble the start of embedded fonts so they can't be copied out
+// of the book, the text is left readable.
+var fontObfuscation = map[string]bool{
+	"http://www.idpf.org/2008/embedding": true,
+	"http://ns.adobe.com/pdf/enc#RC":     true,
+}
+
+// encryptionFile holds the encrypted files of META-INF/encryption.xml
+type encryptionFile struct {
+	Data []struct {
+		Method struct {
+			Algorithm string `xml:"Algorithm,attr"`
+		} `xml:"EncryptionMethod"`
+		Reference struct {
+			URI string `xml:"URI,attr"`
+		} `xml:"CipherData>CipherReference"`
+	} `xml:"EncryptedData"`
+}
+
+// encryptedContent returns the first content document of the book that is
+// encrypted, which makes the book unreadable without its key, or "". Fonts
+// that are only obfuscated don't matter, the converter doesn't read them.
+// An encryption.xml that can't be read is taken to encrypt the whole book.
+func encryptedContent(z *zip.Reader, opfPath string, pkg *opfPackage) (string, error) {
+	data, err := readZipFile(z, encryptionPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return encryptionPath, err
+	}
+	encryption := &encryptionFile{}
+	if err := xml.Unmarshal(data, encryption); err != nil {
+		return encryptionPath, err
+	}
+
+	content := make(map[string]bool)
+	for _, item := range pkg.Items {
+		if contentMediaTypes[item.MediaType] {
+			itemPath, _ := resolveHREF(opfPath, item.HREF)
+			content[itemPath] = true
+		}
+	}
+	for _, encrypted := range encryption.Data {
+		if fontObfuscation[encrypted.Method.Algorithm] {
+			continue
+		}
+		//references are relative to the root of the container
+		encryptedPath, _ := resolveHREF("/", encrypted.Reference.URI)
+		if content[encryptedPath[1:]] {
+			return encryptedPath[1:], nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// fileCache holds files loaded for the options, like rule sets, word lists
+// and tokenizers, sharing them between callers that ask for the same file. A
+// file is loaded again once its modification time or size changes, so the
+// long-running serve and watch modes pick up edits.
+type fileCache[T any] struct {
+	mu      sync.Mutex
+	entries map[string]fileCacheEntry[T]
+	load    func(path string, data []byte) (T, error)
+}
+
+// fileCacheEntry is a loaded file and the state it was loaded in
+type fileCacheEntry[T any] struct {
+	modTime time.Time
+	size    int64
+	value   T
+}
+
+func newFileCache[T any](load func(path string, data []byte) (T, error)) *fileCache[T] {
+	return &fileCache[T]{entries: make(map[string]fileCacheEntry[T]), load: load}
+}
+
+// get returns the file at path, loading it when it isn't cached or changed
+// since it was loaded.
+func (c *fileCache[T]) get(path string) (T, error) {
+	var zero T
+	info, err := os.Stat(path)
+	if err != nil {
+		return zero, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[path]; ok && entry.modTime.Equal(info.ModTime()) && entry.size == info.Size() {
+		return entry.value, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return zero, err
+	}
+	value, err := c.load(path, data)
+	if err != nil {
+		return zero, err
+	}
+	c.entries[path] = fileCacheEntry[T]{modTime: info.ModTime(), size: info.Size(), value: value}
+	return value, nil
+}
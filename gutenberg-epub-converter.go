@@ -2,22 +2,26 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
 	"io"
 	"io/fs"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 	"unicode"
-	"regexp"
-	"golang.org/x/text/runes"
-	"golang.org/x/text/transform"
-    "golang.org/x/text/unicode/norm"
+	"unicode/utf8"
 
 	termbox "github.com/nsf/termbox-go"
 	"golang.org/x/net/html"
@@ -33,6 +37,28 @@ type parser struct {
 	doc       cellbuf
 	items     []epub.Item
 	sb        strings.Builder
+	opts      parseOptions
+	//skipName and skipDepth track an element that is left out, headingSkip
+	//and headingDepth a section, see skipStartTag
+	skipName     string
+	skipDepth    int
+	headingSkip  int
+	headingDepth int
+	//hintStack holds the class hints of the open elements, sheets the
+	//stylesheets of the document and bodyStart where its body starts in sb
+	hintStack []string
+	sheets    []*styleSheet
+	bodyStart int
+	//side holds the side channel text of the document, sideDepth the depth
+	//of the element of its open entry
+	side      []sideText
+	sideDepth int
+	//rubyStart is where the base text of the next ruby annotation starts
+	rubyStart int
+	//dirStack holds the directions of the open elements and dirMark the mark
+	//written before the next text, see startDir
+	dirStack []dirEntry
+	dirMark  string
 }
 
 // cellbuf is a part of the goreader repo for parsing epubs
@@ -63,9 +89,21 @@ type metadata struct {
 	relation    string
 	coverage    string
 	rights      string
+	quality     *qualityReport
+	tokenCount  int
+	typography  string
+	repairs     []stageStat
+	//matterDropped counts the documents and sections left out per matter class
+	matterDropped map[string]int
+	//direction is the writing direction of the book, ltr or rtl, when known
+	direction string
+	//transcoded counts the documents transcoded to UTF-8 per encoding
+	transcoded map[string]int
+	//recovered lists what had to be recovered of a malformed book, see openBook
+	recovered []string
 }
 
-//tracks the config of the program
+// tracks the config of the program
 type programConfig struct {
 	writeHeader       bool
 	writeMetadata     bool
@@ -75,7 +113,29 @@ type programConfig struct {
 	silent            bool
 	skipCopyRight     bool
 	gutenbergCleaning bool
+	rules             *ruleSet
+	pipeline          []Cleaner
+	audit             string
+	typography        string
+	dictionary        map[string]bool
+	keepMatter        map[string]bool
+	nonLinear         string
+	css               bool
+	elementPolicy     map[atom.Atom]string
+	ruby              string
+	bidi              string
 	createSubsets     string
+	outputFormat      string
+	dedup             *dedupIndex
+	quality           qualityThresholds
+	tokenizer         *bpeTokenizer
+	minTokens         int
+	maxTokens         int
+	eotToken          int
+	tokenOutput       *tokenWriter
+	chunkSize         int
+	chunkUnit         string
+	chunkOverlap      int
 }
 
 // Mini struct for files
@@ -96,67 +156,128 @@ type programCounter struct {
 	finishedBooksCount            int
 	skippedDueToCopyRight         int
 	skippedDueToInsuffcientLength int
-	charCleanedCount              int
+	stages                        []stageStat
+	skippedDueToDuplicate         int
+	skippedDueToLowQuality        int
+	skippedDueToTokenBudget       int
+	skippedDueToEncryption        int
+	tokenCount                    int
 }
 
-func main() {
-	//flags used: -url is the url to scrape,
-	// -data_dir is the directory to save the files to
-	inputPTR := flag.String("inputDir", "./input",
-		"directory that the book files will convert from. Defaults to './input'")
+// Reasons a book is left out of the output
+const (
+	skipCopyRight          = "copyright"
+	skipInsufficientLength = "insufficient length"
+	skipDuplicate          = "duplicate"
+	skipLowQuality         = "low quality"
+	skipTokenBudget        = "token budget"
+	skipEncrypted          = "encrypted"
+)
 
-	outputPTR := flag.String("outputDir", "./output",
-		"directory that the book files will convert to. Defaults to './output'")
+// bookResult is the outcome of converting a single book
+type bookResult struct {
+	meta         *metadata
+	text         string
+	side         []sideText
+	skipReason   string
+	rawCharCount int
+	stages       []stageStat
+	audit        *cleanAudit
+	duration     time.Duration
+}
 
-	writeHeaderPtr := flag.Bool("writeHeader", true,
-		"Saves the book title and author to the top of the file. Defaults to true")
+// bookRecord is the json form of a converted book
+type bookRecord struct {
+	Title       string          `json:"title"`
+	Author      string          `json:"author"`
+	Publisher   string          `json:"publisher"`
+	Language    string          `json:"language"`
+	Description string          `json:"description"`
+	CharCount   int             `json:"charCount"`
+	Filename    string          `json:"filename"`
+	Identifier  string          `json:"identifier"`
+	Categories  []string        `json:"categories"`
+	Format      string          `json:"format"`
+	Relation    string          `json:"relation"`
+	Coverage    string          `json:"coverage"`
+	Rights      string          `json:"rights"`
+	Typography  string          `json:"typography"`
+	Direction   string          `json:"direction,omitempty"`
+	Recovered   []string        `json:"recovered,omitempty"`
+	Quality     *qualityReport  `json:"quality"`
+	Stats       bookStats       `json:"stats"`
+	Chapters    []chapterRecord `json:"chapters"`
+	Side        []sideText      `json:"side,omitempty"`
+}
 
-	writeMetadataPtr := flag.Bool("writeMetadata", false,
-		"Saves the book metadata to another file. Defaults to false")
+// bookStats are the conversion statistics of a single book
+type bookStats struct {
+	RawCharCount int         `json:"rawCharCount"`
+	CharCount    int         `json:"charCount"`
+	CharsRemoved int         `json:"charsRemoved"`
+	WordCount    int         `json:"wordCount"`
+	ChapterCount int         `json:"chapterCount"`
+	TokenCount   int         `json:"tokenCount,omitempty"`
+	DurationMs   int64       `json:"durationMs"`
+	Stages       []stageStat `json:"stages"`
+	//MatterDropped counts the documents and sections left out per matter class
+	MatterDropped map[string]int `json:"matterDropped,omitempty"`
+	//Transcoded counts the documents transcoded to UTF-8 per encoding
+	Transcoded map[string]int `json:"transcoded,omitempty"`
+}
 
-	cleanOutputPtr := flag.Bool("cleanOutput", true,
-		"Removes strange characters and spacing. Defaults to true")
+// chapterRecord is one chapter of a converted book
+type chapterRecord struct {
+	Index int    `json:"index"`
+	Title string `json:"title"`
+	Text  string `json:"text"`
+}
 
-	seperateFoldersPtr := flag.Bool("seperateFolders", false,
-		"Creates a seperate folder for each book. Defaults to false")
+// logOutput receives progress messages, see logf
+var logOutput io.Writer = os.Stdout
 
-	stopEarlyPtr := flag.Int("stopEarly", 0,
-		"Stops after a certain number of books. Defaults to 0 (no limit)")
+func main() {
+	//subcommands get their own flag sets, everything else is the classic directory conversion
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "convert":
+			runConvertCommand(os.Args[2:])
+			return
+		case "serve":
+			runServeCommand(os.Args[2:])
+			return
+		case "validate":
+			runValidateCommand(os.Args[2:])
+			return
+		}
+	}
 
-	silentPtr := flag.Bool("silent", false,
-		"Doesn't print anything to the console. Defaults to false")
+	//flags used: -inputDir is the directory to convert from,
+	// -outputDir is the directory to save the files to
+	inputPTR := flag.String("inputDir", "./input",
+		"directory that the book files will convert from. Defaults to './input'")
 
-	skipCopyRightPtr := flag.Bool("skipCopyRight", false,
-		"Skips books that have a copy right. Defaults to false")
+	outputPTR := flag.String("outputDir", "./output",
+		"directory that the book files will convert to. Defaults to './output'")
 
-	gutenbergCleaningPtr := flag.Bool("gutenbergCleaning", false,
-		"Additions to the cleaning process for gutenberg books."+
-			"Must be used with -cleanOutput. Defaults to false")
+	watchPtr := flag.Bool("watch", false,
+		"Keeps running after the conversion and converts books as they are added, changed or removed. Defaults to false")
 
-	createSubsetsPtr := flag.String("createSubsets", "book",
-		"Creates subsets of the books based on the metadata."+
-			"Options: author, category, book, categoryauthor. Defaults to 'book'")
+	watchDebouncePtr := flag.Duration("watchDebounce", 2*time.Second,
+		"How long a book must stay unchanged before it is converted in watch mode. Defaults to 2s")
+
+	flags := registerConfigFlags(flag.CommandLine)
 
 	flag.Parse()
 
-	//check createSubsets is valid
-	if *createSubsetsPtr != "author" && *createSubsetsPtr != "category" &&
-		*createSubsetsPtr != "book" && *createSubsetsPtr != "categoryauthor" {
-		fmt.Println("Error: createSubsets must be one of the following: author, category, book, categoryauthor")
-		*createSubsetsPtr = "book"
+	config, err := flags.config()
+	if err != nil {
+		fmt.Println("Error:", err)
 		return
 	}
-
-	config := programConfig{
-		writeHeader:       *writeHeaderPtr,
-		writeMetadata:     *writeMetadataPtr,
-		cleanOutput:       *cleanOutputPtr,
-		seperateFolders:   *seperateFoldersPtr,
-		stopEarly:         *stopEarlyPtr,
-		silent:            *silentPtr,
-		skipCopyRight:     *skipCopyRightPtr,
-		gutenbergCleaning: *gutenbergCleaningPtr,
-		createSubsets:     *createSubsetsPtr,
+	if *watchDebouncePtr < 0 {
+		fmt.Println("Error: watchDebounce can't be negative")
+		return
 	}
 	counters := programCounter{
 		bookCount:                     0,
@@ -166,23 +287,14 @@ func main() {
 		timeEnd:                       time.Now(),
 		finishedBooksCount:            0,
 		skippedDueToCopyRight:         0,
-		charCleanedCount:              0,
 		skippedDueToInsuffcientLength: 0,
 	}
 	//Write params
 	if !config.silent {
 		fmt.Println("Input Directory: ", *inputPTR)
 		fmt.Println("Output Directory: ", *outputPTR)
-		fmt.Println("Write Header: ", config.writeHeader)
-		fmt.Println("Write Metadata: ", config.writeMetadata)
-		fmt.Println("Clean Output: ", config.cleanOutput)
-		fmt.Println("Seperate Folders: ", config.seperateFolders)
-		fmt.Println("Stop Early: ", config.stopEarly)
-		fmt.Println("Silent: ", config.silent)
-		fmt.Println("Skip Copy Right: ", config.skipCopyRight)
-		fmt.Println("Gutenberg Cleaning: ", config.gutenbergCleaning)
-		fmt.Println("Create Subsets: ", config.createSubsets)
-		fmt.Println("------------\nStarting...\n")
+		printConfig(config)
+		fmt.Print("------------\nStarting...\n\n")
 	}
 
 	//create output directory if it doesn't exist
@@ -193,7 +305,389 @@ func main() {
 	//get all files in directory
 	files := aquireEpubFilePaths(*inputPTR, config, &counters)
 
-	ConvertEpubGo(files, *inputPTR, *outputPTR, config, &counters)
+	outputs := ConvertEpubGo(files, *inputPTR, *outputPTR, config, &counters)
+
+	if *watchPtr {
+		if config.outputFormat == "tokens" {
+			log.Fatal("watch mode can't update the tokens output, use text or json")
+		}
+		err := watchInputDir(*inputPTR, *outputPTR, config, flags, &counters, outputs, *watchDebouncePtr)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// configFlags holds the flag values that make up a programConfig, so the
+// directory mode and the subcommands share one set of options.
+type configFlags struct {
+	writeHeaderPtr       *bool
+	writeMetadataPtr     *bool
+	cleanOutputPtr       *bool
+	seperateFoldersPtr   *bool
+	stopEarlyPtr         *int
+	silentPtr            *bool
+	skipCopyRightPtr     *bool
+	gutenbergCleaningPtr *bool
+	rulesPtr             *string
+	pipelinePtr          *string
+	auditPtr             *string
+	typographyPtr        *string
+	dictionaryPtr        *string
+	keepMatterPtr        *string
+	nonLinearPtr         *string
+	cssPtr               *bool
+	elementPolicyPtr     *string
+	rubyPtr              *string
+	bidiPtr              *string
+	createSubsetsPtr     *string
+	outputFormatPtr      *string
+	dedupPtr             *string
+	dedupThresholdPtr    *float64
+	quality              qualityThresholds
+	tokenizerPtr         *string
+	minTokensPtr         *int
+	maxTokensPtr         *int
+	eotTokenPtr          *string
+	chunkSizePtr         *int
+	chunkUnitPtr         *string
+	chunkOverlapPtr      *int
+}
+
+// registerConfigFlags defines the conversion options on the given flag set.
+func registerConfigFlags(fs *flag.FlagSet) *configFlags {
+	flags := new(configFlags)
+
+	flags.writeHeaderPtr = fs.Bool("writeHeader", true,
+		"Saves the book title and author to the top of the file. Defaults to true")
+
+	flags.writeMetadataPtr = fs.Bool("writeMetadata", false,
+		"Saves the book metadata to another file. Defaults to false")
+
+	flags.cleanOutputPtr = fs.Bool("cleanOutput", true,
+		"Removes strange characters and spacing. Defaults to true")
+
+	flags.seperateFoldersPtr = fs.Bool("seperateFolders", false,
+		"Creates a seperate folder for each book. Defaults to false")
+
+	flags.stopEarlyPtr = fs.Int("stopEarly", 0,
+		"Stops after a certain number of books. Defaults to 0 (no limit)")
+
+	flags.silentPtr = fs.Bool("silent", false,
+		"Doesn't print anything to the console. Defaults to false")
+
+	flags.skipCopyRightPtr = fs.Bool("skipCopyRight", false,
+		"Skips books that have a copy right. Defaults to false")
+
+	flags.gutenbergCleaningPtr = fs.Bool("gutenbergCleaning", false,
+		"Additions to the cleaning process for gutenberg books."+
+			"Must be used with -cleanOutput. Defaults to false")
+
+	flags.rulesPtr = fs.String("rules", "",
+		"JSON file with the line rules applied by -gutenbergCleaning. Defaults to the built-in gutenberg rules")
+
+	flags.pipelinePtr = fs.String("pipeline", "",
+		"Comma separated cleaning stages to run, overriding -cleanOutput and -gutenbergCleaning. "+
+			"Stages: "+strings.Join(cleanerNames(), ", ")+". Defaults to the stages picked by -cleanOutput and -gutenbergCleaning")
+
+	flags.typographyPtr = fs.String("typography", typographyLegacy,
+		"How the normalize stage treats quotes, dashes, spaces, ligatures and invisible characters. "+
+			"Options: legacy (curly quotes and non-breaking spaces only), preserve, ascii, nfkc. Defaults to 'legacy'")
+
+	flags.dictionaryPtr = fs.String("dictionary", "",
+		"Word list, one word per line, used by the dehyphenate and dropcaps stages next to the words of the book itself. "+
+			"Defaults to none")
+
+	flags.keepMatterPtr = fs.String("keepMatter", "all",
+		"Comma separated matter classes to keep, from the epub:type annotations, landmarks and guide of the book. "+
+			"Classes: all, "+strings.Join(matterClasses, ", ")+". Text that isn't classified is always kept. Defaults to 'all'")
+
+	flags.nonLinearPtr = fs.String("nonLinear", "drop",
+		"What to do with spine items marked linear=\"no\", like cover pages, pop-up notes and answer keys. "+
+			"Options: drop, append (after the rest of the book), inline (in spine order). Defaults to 'drop'")
+
+	flags.cssPtr = fs.Bool("css", true,
+		"Leaves out text hidden by the stylesheets of the book (display:none, screen reader only text, the hidden class) "+
+			"and follows the chapter, poem, letter and footnote classes. Defaults to true")
+
+	flags.elementPolicyPtr = fs.String("elementPolicy", "",
+		"Comma separated element=policy pairs changing what happens to the text of an element: emit, skip or side "+
+			"(written to <book>.side.txt, or the side field of the json output). Defaults to skipping head (but not title), style, script, "+
+			"noscript, template, nav, svg and math annotations, and setting aside the text of aside")
+
+	flags.rubyPtr = fs.String("ruby", "drop",
+		"What to do with ruby annotations like furigana. Options: drop, paren (after the base text in parentheses), "+
+			"separate (in the side channel with their base text). Defaults to 'drop'")
+
+	flags.bidiPtr = fs.String("bidi", "preserve",
+		"What to do with the bidi controls and dir attributes of right-to-left books. Options: preserve (keeps the controls "+
+			"and writes dir attributes as isolates and marks), normalize (removes all bidi controls). Defaults to 'preserve'")
+
+	flags.auditPtr = fs.String("audit", "off",
+		"Writes what cleaning removed from each book next to it. Options: off, json (<book>.audit.json), "+
+			"html (also a side-by-side diff in <book>.audit.html). Defaults to 'off'")
+
+	flags.createSubsetsPtr = fs.String("createSubsets", "book",
+		"Creates subsets of the books based on the metadata."+
+			"Options: author, category, book, categoryauthor. Defaults to 'book'")
+
+	flags.outputFormatPtr = fs.String("outputFormat", "text",
+		"Format of the converted books. Options: text, json, tokens (binary token ids, needs -tokenizer), "+
+			"chunks (json lines of training windows), sentences (one sentence per line), "+
+			"sentencesjson (json lines of sentences keyed by chapter and paragraph). Defaults to 'text'")
+
+	flags.dedupPtr = fs.String("dedup", "off",
+		"Detects exact and near-duplicate books. Options: off, skip (only keep the first edition), "+
+			"report (keep all, write dedup-report.json). Defaults to 'off'")
+
+	flags.dedupThresholdPtr = fs.Float64("dedupThreshold", 0.8,
+		"Estimated Jaccard similarity above which two books are duplicates. Defaults to 0.8")
+
+	fs.IntVar(&flags.quality.minChars, "minChars", 2000,
+		"Skips books shorter than this many characters after cleaning. Defaults to 2000")
+
+	fs.Float64Var(&flags.quality.minAlphaRatio, "minAlphaRatio", 0.6,
+		"Skips books where fewer of the non-space characters are letters. 0 disables. Defaults to 0.6")
+
+	fs.Float64Var(&flags.quality.minMeanWordLength, "minMeanWordLength", 2.5,
+		"Skips books with a shorter mean word length. 0 disables. Defaults to 2.5")
+
+	fs.Float64Var(&flags.quality.maxMeanWordLength, "maxMeanWordLength", 12,
+		"Skips books with a longer mean word length. 0 disables. Defaults to 12")
+
+	fs.Float64Var(&flags.quality.maxDuplicateLineRatio, "maxDuplicateLineRatio", 0.3,
+		"Skips books where more of the lines repeat an earlier line. 0 disables. Defaults to 0.3")
+
+	fs.Float64Var(&flags.quality.maxSymbolRatio, "maxSymbolRatio", 0.1,
+		"Skips books with more symbols per word. 0 disables. Defaults to 0.1")
+
+	fs.Float64Var(&flags.quality.maxIndexLineRatio, "maxIndexLineRatio", 0.5,
+		"Skips books where more of the lines look like index or contents entries. 0 disables. Defaults to 0.5")
+
+	fs.Float64Var(&flags.quality.minMeanParagraphLength, "minParagraphLength", 3,
+		"Skips books with fewer words per paragraph on average. 0 disables. Defaults to 3")
+
+	flags.tokenizerPtr = fs.String("tokenizer", "",
+		"Path to a tokenizer used to count tokens, either a Hugging Face tokenizer.json "+
+			"(byte-level BPE) or a tiktoken rank file. Defaults to none")
+
+	flags.minTokensPtr = fs.Int("minTokens", 0,
+		"Skips books with fewer tokens. Needs -tokenizer. Defaults to 0 (no limit)")
+
+	flags.maxTokensPtr = fs.Int("maxTokens", 0,
+		"Skips books with more tokens. Needs -tokenizer. Defaults to 0 (no limit)")
+
+	flags.eotTokenPtr = fs.String("eotToken", "<|endoftext|>",
+		"End-of-document token written after each book in the tokens output, as text or id. Defaults to '<|endoftext|>'")
+
+	flags.chunkSizePtr = fs.Int("chunkSize", 1000,
+		"Target size of a chunk in the chunks output, in -chunkUnit. Defaults to 1000")
+
+	flags.chunkUnitPtr = fs.String("chunkUnit", "words",
+		"Unit of -chunkSize and -chunkOverlap. Options: chars, words, tokens (needs -tokenizer). Defaults to 'words'")
+
+	flags.chunkOverlapPtr = fs.Int("chunkOverlap", 0,
+		"How much of the end of a chunk is repeated at the start of the next one, in -chunkUnit. Defaults to 0")
+
+	return flags
+}
+
+// config validates the parsed flags and builds the programConfig from them.
+func (flags *configFlags) config() (programConfig, error) {
+	//check createSubsets is valid
+	if *flags.createSubsetsPtr != "author" && *flags.createSubsetsPtr != "category" &&
+		*flags.createSubsetsPtr != "book" && *flags.createSubsetsPtr != "categoryauthor" {
+		return programConfig{}, fmt.Errorf("createSubsets must be one of the following: author, category, book, categoryauthor")
+	}
+
+	//check outputFormat is valid
+	if *flags.outputFormatPtr != "text" && *flags.outputFormatPtr != "json" && *flags.outputFormatPtr != "tokens" &&
+		*flags.outputFormatPtr != "chunks" && *flags.outputFormatPtr != "sentences" && *flags.outputFormatPtr != "sentencesjson" {
+		return programConfig{}, fmt.Errorf("outputFormat must be one of the following: text, json, tokens, chunks, sentences, sentencesjson")
+	}
+	if *flags.outputFormatPtr == "tokens" && *flags.tokenizerPtr == "" {
+		return programConfig{}, fmt.Errorf("outputFormat tokens needs a tokenizer")
+	}
+
+	//check dedup is valid
+	if *flags.dedupPtr != "off" && *flags.dedupPtr != "skip" && *flags.dedupPtr != "report" {
+		return programConfig{}, fmt.Errorf("dedup must be one of the following: off, skip, report")
+	}
+	if *flags.dedupThresholdPtr <= 0 || *flags.dedupThresholdPtr > 1 {
+		return programConfig{}, fmt.Errorf("dedupThreshold must be between 0 and 1")
+	}
+
+	//check chunking is valid
+	if *flags.chunkUnitPtr != "chars" && *flags.chunkUnitPtr != "words" && *flags.chunkUnitPtr != "tokens" {
+		return programConfig{}, fmt.Errorf("chunkUnit must be one of the following: chars, words, tokens")
+	}
+	if *flags.chunkSizePtr < 1 || *flags.chunkOverlapPtr < 0 || *flags.chunkOverlapPtr >= *flags.chunkSizePtr {
+		return programConfig{}, fmt.Errorf("chunkSize must be positive and chunkOverlap smaller than chunkSize")
+	}
+	if *flags.outputFormatPtr == "chunks" && *flags.chunkUnitPtr == "tokens" && *flags.tokenizerPtr == "" {
+		return programConfig{}, fmt.Errorf("chunkUnit tokens needs a tokenizer")
+	}
+
+	if *flags.tokenizerPtr == "" && (*flags.minTokensPtr > 0 || *flags.maxTokensPtr > 0) {
+		return programConfig{}, fmt.Errorf("minTokens and maxTokens need a tokenizer")
+	}
+
+	//check the pipeline is valid
+	pipelineSpec := *flags.pipelinePtr
+	if pipelineSpec == "" {
+		pipelineSpec = defaultPipeline(*flags.cleanOutputPtr, *flags.gutenbergCleaningPtr)
+	}
+	pipeline, err := buildPipeline(pipelineSpec)
+	if err != nil {
+		return programConfig{}, err
+	}
+	if *flags.typographyPtr != typographyLegacy && *flags.typographyPtr != typographyPreserve && *flags.typographyPtr != typographyASCII && *flags.typographyPtr != typographyNFKC {
+		return programConfig{}, fmt.Errorf("typography must be one of the following: legacy, preserve, ascii, nfkc")
+	}
+	if *flags.auditPtr != "off" && *flags.auditPtr != "json" && *flags.auditPtr != "html" {
+		return programConfig{}, fmt.Errorf("audit must be one of the following: off, json, html")
+	}
+	if *flags.nonLinearPtr != nonLinearAppend && *flags.nonLinearPtr != nonLinearDrop && *flags.nonLinearPtr != nonLinearInline {
+		return programConfig{}, fmt.Errorf("nonLinear must be one of the following: drop, append, inline")
+	}
+	if *flags.rubyPtr != rubyDrop && *flags.rubyPtr != rubyParen && *flags.rubyPtr != rubySeparate {
+		return programConfig{}, fmt.Errorf("ruby must be one of the following: drop, paren, separate")
+	}
+	if *flags.bidiPtr != bidiPreserve && *flags.bidiPtr != bidiNormalize {
+		return programConfig{}, fmt.Errorf("bidi must be one of the following: preserve, normalize")
+	}
+	elementPolicy, err := parseElementPolicy(*flags.elementPolicyPtr, *flags.rubyPtr)
+	if err != nil {
+		return programConfig{}, err
+	}
+	keepMatter, err := parseMatterClasses(*flags.keepMatterPtr)
+	if err != nil {
+		return programConfig{}, err
+	}
+	if *flags.rulesPtr != "" && !pipelineHas(pipeline, "gutenberg") {
+		return programConfig{}, fmt.Errorf("rules needs gutenbergCleaning or the gutenberg pipeline stage")
+	}
+
+	config := programConfig{
+		writeHeader:       *flags.writeHeaderPtr,
+		writeMetadata:     *flags.writeMetadataPtr,
+		cleanOutput:       *flags.cleanOutputPtr,
+		seperateFolders:   *flags.seperateFoldersPtr,
+		stopEarly:         *flags.stopEarlyPtr,
+		silent:            *flags.silentPtr,
+		skipCopyRight:     *flags.skipCopyRightPtr,
+		gutenbergCleaning: *flags.gutenbergCleaningPtr,
+		pipeline:          pipeline,
+		audit:             *flags.auditPtr,
+		typography:        *flags.typographyPtr,
+		keepMatter:        keepMatter,
+		nonLinear:         *flags.nonLinearPtr,
+		css:               *flags.cssPtr,
+		elementPolicy:     elementPolicy,
+		ruby:              *flags.rubyPtr,
+		bidi:              *flags.bidiPtr,
+		createSubsets:     *flags.createSubsetsPtr,
+		outputFormat:      *flags.outputFormatPtr,
+		quality:           flags.quality,
+		minTokens:         *flags.minTokensPtr,
+		maxTokens:         *flags.maxTokensPtr,
+		chunkSize:         *flags.chunkSizePtr,
+		chunkUnit:         *flags.chunkUnitPtr,
+		chunkOverlap:      *flags.chunkOverlapPtr,
+	}
+	if err := flags.loadFiles(&config); err != nil {
+		return programConfig{}, err
+	}
+	if *flags.dedupPtr != "off" {
+		config.dedup = newDedupIndex(*flags.dedupPtr, *flags.dedupThresholdPtr)
+	}
+	return config, nil
+}
+
+// loadFiles loads the word list, rules and tokenizer files named by the flags
+// into config. Files that are already loaded are only read again when they
+// changed, so watch mode calls it before every book to pick up edits.
+func (flags *configFlags) loadFiles(config *programConfig) error {
+	if *flags.dictionaryPtr != "" {
+		dictionary, err := loadDictionary(*flags.dictionaryPtr)
+		if err != nil {
+			return err
+		}
+		config.dictionary = dictionary
+	}
+	if pipelineHas(config.pipeline, "gutenberg") {
+		rules, err := loadRuleSet(*flags.rulesPtr)
+		if err != nil {
+			return err
+		}
+		config.rules = rules
+	}
+	if *flags.tokenizerPtr != "" {
+		tokenizer, err := loadTokenizer(*flags.tokenizerPtr)
+		if err != nil {
+			return err
+		}
+		eot, ok := tokenizer.lookup(*flags.eotTokenPtr)
+		if !ok && config.outputFormat == "tokens" {
+			return fmt.Errorf("eotToken %q is not in the tokenizer, give its id instead", *flags.eotTokenPtr)
+		}
+		config.tokenizer = tokenizer
+		config.eotToken = eot
+	}
+	return nil
+}
+
+// printConfig writes the active conversion options to the log output.
+func printConfig(config programConfig) {
+	fmt.Fprintln(logOutput, "Write Header: ", config.writeHeader)
+	fmt.Fprintln(logOutput, "Write Metadata: ", config.writeMetadata)
+	fmt.Fprintln(logOutput, "Clean Output: ", config.cleanOutput)
+	fmt.Fprintln(logOutput, "Seperate Folders: ", config.seperateFolders)
+	fmt.Fprintln(logOutput, "Stop Early: ", config.stopEarly)
+	fmt.Fprintln(logOutput, "Silent: ", config.silent)
+	fmt.Fprintln(logOutput, "Skip Copy Right: ", config.skipCopyRight)
+	fmt.Fprintln(logOutput, "Gutenberg Cleaning: ", config.gutenbergCleaning)
+	fmt.Fprintln(logOutput, "Pipeline: ", pipelineString(config.pipeline))
+	fmt.Fprintln(logOutput, "Typography: ", config.typography)
+	fmt.Fprintln(logOutput, "Non-linear: ", config.nonLinear)
+	fmt.Fprintln(logOutput, "CSS: ", config.css)
+	fmt.Fprintln(logOutput, "Ruby: ", config.ruby)
+	fmt.Fprintln(logOutput, "Bidi: ", config.bidi)
+	if policy := elementPolicyString(config.elementPolicy); policy != "" {
+		fmt.Fprintln(logOutput, "Element Policy: ", policy)
+	}
+	if config.keepMatter != nil {
+		kept := []string{}
+		for _, class := range matterClasses {
+			if config.keepMatter[class] {
+				kept = append(kept, class)
+			}
+		}
+		fmt.Fprintln(logOutput, "Keep Matter: ", strings.Join(kept, ","))
+	}
+	if config.audit != "off" {
+		fmt.Fprintln(logOutput, "Audit: ", config.audit)
+	}
+	if config.rules != nil {
+		fmt.Fprintln(logOutput, "Rules: ", config.rules.name, "("+strconv.Itoa(len(config.rules.Rules))+" rules)")
+	}
+	fmt.Fprintln(logOutput, "Create Subsets: ", config.createSubsets)
+	fmt.Fprintln(logOutput, "Output Format: ", config.outputFormat)
+	if config.outputFormat == "chunks" {
+		fmt.Fprintln(logOutput, "Chunks: ", config.chunkSize, config.chunkUnit, "overlap", config.chunkOverlap)
+	}
+	if config.tokenizer != nil {
+		fmt.Fprintln(logOutput, "Tokenizer: ", config.tokenizer.path, "min tokens", config.minTokens, "max tokens", config.maxTokens)
+	}
+	if config.dedup != nil {
+		fmt.Fprintln(logOutput, "Dedup: ", config.dedup.mode, "threshold", config.dedup.threshold)
+	}
+}
+
+// logf writes progress messages. They go to stdout by default, and to stderr
+// when stdout carries the converted book itself.
+func logf(format string, a ...interface{}) {
+	fmt.Fprintf(logOutput, format, a...)
 }
 
 func aquireEpubFilePaths(inputdir string, config programConfig, counters *programCounter) []fileTrack {
@@ -233,193 +727,519 @@ func checkMetaForCopyright(meta metadata) bool {
 }
 
 // A lot of the actual parsing is done with this repo: https://github.com/taylorskalyo/goreader
-func ConvertEpubGo(files []fileTrack, inputdir string, outputdir string, config programConfig, counters *programCounter) {
+// ConvertEpubGo returns the files written for each converted book, keyed by
+// the path of the epub.
+func ConvertEpubGo(files []fileTrack, inputdir string, outputdir string, config programConfig, counters *programCounter) map[string][]string {
 	//we time the parsing
 	counters.timeStart = time.Now()
+	outputs := make(map[string][]string)
+
+	//tokenized books all go into one binary file
+	if config.outputFormat == "tokens" {
+		tokenOutput, err := newTokenWriter(outputdir, config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.tokenOutput = tokenOutput
+	}
 
 	//for each file, if it is an epub, convert it to txt
 	for _, file := range files {
 		if strings.HasSuffix(file.name, ".epub") {
 			//fmt.Printf("Open files %d\n", countOpenFiles()) //debugging
-			//We use the goreader library to parse the epub
-			rc, err := epub.OpenReader(file.path)
+			result, err := convertEpubFile(file, config, counters)
 			if err != nil {
-				panic(err)
+				log.Fatal(err)
+			}
+			if result.skipReason != "" {
+				continue
 			}
-			defer rc.Close()
-			// The rootfile (content.opf) lists all of the contents of an epub file.
-			// There may be multiple rootfiles, although typically there is only one.
-			book := rc.Rootfiles[0]
 
-			// Print book title.
-			if !config.silent {
-				fmt.Println("Parsing book: ", book.Title, "(file: ", file.name+")")
+			written, err := writeBookOutput(file, result, outputdir, config)
+			if err != nil {
+				log.Fatal(err)
 			}
+			outputs[file.path] = written
+			counters.finishedBooksCount++
+		}
 
-			//stringbuilder to hold the text instead of using goreader's cell system
-			var sb strings.Builder
+	}
 
-			bookstr := ""
-			//iterate through each chapter in the book
-			for _, itemref := range book.Spine.Itemrefs {
-				f, err := itemref.Open()
-				if err != nil {
-					log.Fatal(fmt.Printf("Error opening %s: %s\n", itemref.ID, err))
-				}
+	if config.tokenOutput != nil {
+		if err := config.tokenOutput.close(); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-				//parse the chapter into the stringbuilder
-				sbret, err := parseText(f, book.Manifest.Items, sb)
-				if err != nil {
-					log.Fatal(err)
-				}
-				bookstr += "CHAPTER_SEPERATOR"
-				bookstr += sbret.String()
+	if config.dedup != nil {
+		if err := config.dedup.writeReport(outputdir); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-				// Close the itemref.
-				f.Close()
+	if counters.charCount > 0 {
+		printSummary(counters)
+	}
+	return outputs
+}
 
-				//clear the stringbuilder
-				sb.Reset()
-			}
+// writeBookOutput writes a converted book to the output directory and returns
+// the paths of the files it created.
+func writeBookOutput(file fileTrack, result *bookResult, outputdir string, config programConfig) ([]string, error) {
+	outputFilePath := buildOutputFilePath(file, result.meta, outputdir, config)
 
-			//clean the text if cleanOutput is true
-			lenBefore := (len(bookstr))
-			// count the number of characters
-			counters.charCount += len(bookstr)
-			bookstr = cleanEpubString(bookstr, config)
-			//count the number of characters removed
-			counters.charCleanedCount += lenBefore - len(bookstr)
-			fmt.Printf("Removed %d characters from %d characters\n", lenBefore-len(bookstr), lenBefore)
-
-			//if length is less than 2000 characters, skip the file
-			if len(bookstr) < 2000 {
-				fmt.Printf("Skipping file %s, too short (%d characters)\n", file.name, len(bookstr))
-				counters.skippedDueToInsuffcientLength++
-				continue
-			}
+	//creates the path including the folders if they don't exist
+	err := os.MkdirAll(filepath.Dir(outputFilePath), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
 
-			// Write metadata to a separate file if writeMetadata is true
-			bookMeta := new(metadata)
-			bookMeta.title = book.Title
-			bookMeta.author = book.Metadata.Creator
-			bookMeta.publisher = book.Metadata.Publisher
-			bookMeta.language = book.Metadata.Language
-			bookMeta.description = book.Metadata.Description
-			bookMeta.filename = ""
-			bookMeta.charCount = counters.charCount
-			bookMeta.format = book.Metadata.Format
-			bookMeta.categories = []string{}
-			fmt.Printf("Categories: %s\n", book.Metadata.Subject)
-			bookMeta.categories = append(bookMeta.categories, book.Metadata.Subject)
-			//parse seperated categories
-			if len(book.Metadata.Subject) > 0 && strings.Contains(book.Metadata.Subject, " -- ") {
-				bookMeta.categories = strings.Split(book.Metadata.Subject, " -- ")
-			}
+	//the audit goes next to the book, also when the book itself goes to tokens.bin
+	audits := []string{}
+	if result.audit != nil {
+		audits, err = writeAudit(result, outputFilePath, config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	//the json record holds the side channel itself
+	if len(result.side) > 0 && config.outputFormat != "json" {
+		sidePath, err := writeSideText(result, outputFilePath, config)
+		if err != nil {
+			return nil, err
+		}
+		audits = append(audits, sidePath)
+	}
 
-			bookMeta.identifier = book.Metadata.Identifier
-			bookMeta.relation = book.Metadata.Relation
-			bookMeta.coverage = book.Metadata.Coverage
-			bookMeta.rights = book.Metadata.Rights
-
-			//if createSubsets is set to book, we don't change the output directory
-			//if it is set to author, we create a folder for each author
-			//if it is set to category, we create a folder for each category
-			//if it is set to categoryauthor, we create a folder for each category and then a folder for each author in that category
-
-			//generate output file name and file
-			outputFileName := strings.TrimSuffix(file.name, ".epub") + ".txt"
-			outputFilePath := ""
-			seperateFoldersExtension := ""
-			if config.seperateFolders {
-				seperateFoldersExtension = strings.TrimSuffix(file.name, ".epub")
-			}
+	if config.tokenOutput != nil {
+		err := config.tokenOutput.add(file, result, renderBook(result, config))
+		return append([]string{config.tokenOutput.path}, audits...), err
+	}
+	logf("Output file path: %s\n", outputFilePath)
 
-			if config.createSubsets == "book" {
-				outputFilePath = outputdir + "/" + seperateFoldersExtension + "/" + outputFileName
-			} else if config.createSubsets == "author" {
-				outputFilePath = outputdir + "/" + bookMeta.author + "/" + seperateFoldersExtension + "/" + outputFileName
-			} else if config.createSubsets == "category" {
-				outputFilePath = outputdir + "/" + bookMeta.categories[0] + "/" + seperateFoldersExtension + "/" + outputFileName
-			} else if config.createSubsets == "categoryauthor" {
-				outputFilePath = outputdir + "/" + bookMeta.categories[0] + "/" + bookMeta.author + "/" + seperateFoldersExtension + "/" + outputFileName
-			} else {
-				outputFilePath = outputdir + "/" + seperateFoldersExtension + "/" + outputFileName
-			}
+	outputFile, err := os.Create(outputFilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer outputFile.Close()
+	written := append([]string{outputFilePath}, audits...)
 
-			//Fix for s3 - Remove spaces and replace with underscores, replace diacritics with ascii characters
-			reg, _ := regexp.Compile("\\s+")  //compile 
-			outputFilePath = reg.ReplaceAllString(outputFilePath, "_") //remove whitespaces
-			outputFilePath = strings.ReplaceAll(outputFilePath, "‘", "'")
-			outputFilePath = strings.ReplaceAll(outputFilePath, "’", "'")
-			t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC) //remove diacritics, replace with ascii
-			outputFilePath, _, _ = transform.String(t, outputFilePath)
-			reg, _ = regexp.Compile("[^a-zA-Z0-9-_.':\\/]")  //compile 
-			outputFilePath = reg.ReplaceAllString(outputFilePath, "_") //remove offending characters
-
-			fmt.Printf("Output file path: %s\n", outputFilePath)
-
-			if config.skipCopyRight {
-				isRestricted := checkMetaForCopyright(*bookMeta)
-				if isRestricted {
-					//close the file
-					if rc != nil {
-						rc.Close()
-					}
+	if config.writeMetadata {
+		writeMetadataToFile(result.meta, outputFilePath, config)
+		written = append(written, metadataFilePath(outputFilePath, config))
+	}
 
-					if !config.silent {
-						fmt.Println("Skipping restricted book: ", book.Title, "(file: ", file.name+")")
-					}
-					counters.skippedDueToCopyRight++
-					continue
+	//write the book to the file
+	if _, err := outputFile.Write(renderBook(result, config)); err != nil {
+		return written, err
+	}
+	return written, nil
+}
 
-				}
-			}
+// printSummary writes the totals of a conversion run.
+func printSummary(counters *programCounter) {
+	counters.timeEnd = time.Now()
+	elapsed := counters.timeEnd.Sub(counters.timeStart)
+	logf("--------------------\n")
+	logf("Parsing took %s, parsed %d characters at a rate of %d characters per second.\n", elapsed, counters.charCount, int(float64(counters.charCount)/elapsed.Seconds()))
+	charCleanedCount := 0
+	for _, stage := range counters.stages {
+		charCleanedCount += stage.CharsRemoved
+	}
+	logf("Cleaned %d characters, %% of characters removed: %f%%\n", charCleanedCount, float64(charCleanedCount)/float64(counters.charCount)*100)
+	for _, stage := range counters.stages {
+		repairs := ""
+		if stage.Repairs > 0 {
+			repairs = fmt.Sprintf(", %d repairs", stage.Repairs)
+		}
+		logf("  %-12s removed %d characters in %s%s\n", stage.Stage, stage.CharsRemoved, stage.Duration.Round(time.Millisecond), repairs)
+	}
+	logf("Parsed %d books, %d finished and %d skipped due to copy right, %d skipped due to insufficient length after cleaning.\n", counters.bookCount, counters.finishedBooksCount, counters.skippedDueToCopyRight, counters.skippedDueToInsuffcientLength)
+	if counters.tokenCount > 0 {
+		logf("Counted %d tokens in %d finished books.\n", counters.tokenCount, counters.finishedBooksCount)
+	}
+	if counters.skippedDueToTokenBudget > 0 {
+		logf("Skipped %d books outside the token limits.\n", counters.skippedDueToTokenBudget)
+	}
+	if counters.skippedDueToLowQuality > 0 {
+		logf("Skipped %d books that failed the quality thresholds.\n", counters.skippedDueToLowQuality)
+	}
+	if counters.skippedDueToDuplicate > 0 {
+		logf("Skipped %d books as duplicates of an earlier edition.\n", counters.skippedDueToDuplicate)
+	}
+	if counters.skippedDueToEncryption > 0 {
+		logf("Skipped %d books with encrypted content.\n", counters.skippedDueToEncryption)
+	}
+}
 
-			//creates the path including the folders if they don't exist
-			err = os.MkdirAll(filepath.Dir(outputFilePath), os.ModePerm)
-			if err != nil {
-				log.Fatal(err)
-			}
+// convertEpubFile opens an epub on disk and converts it.
+func convertEpubFile(file fileTrack, config programConfig, counters *programCounter) (*bookResult, error) {
+	f, err := os.Open(file.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
 
-			outputFile, err := os.Create(outputFilePath)
-			if err != nil {
-				log.Fatal(err)
-			}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return convertEpub(f, fi.Size(), file.path, config, counters)
+}
 
-			if config.writeMetadata {
-				writeMetadataToFile(bookMeta, outputFilePath, config)
-			}
+// convertEpub parses and cleans a single epub read from r. source is the path
+// of the epub, or a name for books that don't come from a file. Its base name
+// is used for messages and the metadata, the full path tells books apart for
+// dedup. Books that are skipped come back with skipReason set.
+func convertEpub(r io.ReaderAt, size int64, source string, config programConfig, counters *programCounter) (*bookResult, error) {
+	timeStart := time.Now()
+	name := filepath.Base(source)
+	//open the archive and the package document (content.opf), recovering
+	//what can be recovered of malformed books
+	opened, err := openBook(r, size, name)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %w", name, err)
+	}
+	z, book, pkg := opened.z, opened.book, opened.pkg
+	recovered := opened.recovered
+	if len(recovered) > 0 {
+		logf("Recovered malformed book %s: %s\n", name, strings.Join(recovered, ", "))
+	}
+	//books with encrypted text can't be read without their key
+	if encrypted, err := encryptedContent(z, book.FullPath, pkg); encrypted != "" {
+		if err != nil {
+			logf("Skipping encrypted book %s, %s can't be read: %s\n", name, encryptionPath, err)
+		} else {
+			logf("Skipping encrypted book %s, %s is encrypted\n", name, encrypted)
+		}
+		counters.skippedDueToEncryption++
+		return &bookResult{skipReason: skipEncrypted}, nil
+	}
+	matter := loadBookMatter(z, book.FullPath, pkg)
+	var styleSheets map[string]*styleSheet
+	if config.css {
+		styleSheets = loadStyleSheets(z, book.FullPath, pkg)
+	}
+	dropped := make(map[string]int)
+	transcoded := make(map[string]int)
+	side := []sideText{}
+	//the spine says "default" when the book doesn't set a direction
+	direction := pkg.Spine.Direction
+	if direction != "ltr" && direction != "rtl" {
+		direction = ""
+	}
 
-			//write the book title and author to the top of the file if writeHeader is true
-			if config.writeHeader {
-				header := buildMetadataHeader(bookMeta)
-				outputFile.Write([]byte(header))
-			}
+	// Print book title.
+	if !config.silent {
+		logf("Parsing book: %s (file: %s)\n", book.Title, name)
+	}
 
-			//write the book to the file
-			outputFile.Write([]byte(bookstr))
-			counters.finishedBooksCount++
+	//stringbuilder to hold the text instead of using goreader's cell system
+	var sb strings.Builder
 
-			//close the file if not already closed
-			if outputFile != nil {
-				outputFile.Close()
+	bookstr := ""
+	//iterate through each chapter in the book
+	for _, doc := range spineDocs(pkg, book.FullPath, config.nonLinear) {
+		if class := matter.documents[doc.path]; !keepsMatter(config.keepMatter, class) {
+			dropped[class]++
+			continue
+		}
+		data, err := readZipFile(z, doc.path)
+		if err != nil {
+			//a broken member only loses its own text
+			logf("Skipping unreadable document %s of %s: %s\n", doc.path, name, err)
+			if len(recovered) == 0 || recovered[len(recovered)-1] != recoveredDocuments {
+				recovered = append(recovered, recoveredDocuments)
 			}
-			if rc != nil {
-				rc.Close()
+			continue
+		}
+		data, encoding := decodeDocument(data)
+		if encoding != "" {
+			transcoded[encoding]++
+		}
+
+		//parse the chapter into the stringbuilder
+		opts := parseOptions{
+			keepMatter:  config.keepMatter,
+			sections:    matter.sections[doc.path],
+			dropped:     dropped,
+			css:         config.css,
+			docPath:     doc.path,
+			styleSheets: styleSheets,
+
+			elementPolicy: config.elementPolicy,
+			side:          &side,
+			ruby:          config.ruby,
+			bidi:          config.bidi,
+			direction:     &direction,
+		}
+		sbret, err := parseText(bytes.NewReader(data), book.Manifest.Items, sb, opts)
+		if err != nil {
+			return nil, err
+		}
+		bookstr += "CHAPTER_SEPERATOR"
+		bookstr += sbret.String()
+
+		//clear the stringbuilder
+		sb.Reset()
+	}
+
+	//clean the text if cleanOutput is true
+	lenBefore := utf8.RuneCountInString(bookstr)
+	// count the number of characters, not bytes, so non-ASCII books aren't overcounted
+	counters.charCount += lenBefore
+	bookstr, cleaning := cleanEpubString(bookstr, config)
+	//count the number of characters removed by each stage
+	counters.addStageStats(cleaning.stats)
+	logf("Removed %d characters from %d characters\n", lenBefore-utf8.RuneCountInString(bookstr), lenBefore)
+
+	//skip books that are too short, or look like catalogs, indexes or garbled text
+	quality := scoreQuality(bookstr)
+	if reason := config.quality.check(quality); reason != "" {
+		logf("Skipping file %s, %s\n", name, reason)
+		if config.quality.minChars > 0 && quality.CharCount < config.quality.minChars {
+			counters.skippedDueToInsuffcientLength++
+			return &bookResult{skipReason: skipInsufficientLength}, nil
+		}
+		counters.skippedDueToLowQuality++
+		return &bookResult{skipReason: skipLowQuality}, nil
+	}
+
+	//count tokens and apply the token limits
+	tokenCount := 0
+	if config.tokenizer != nil {
+		tokenCount = config.tokenizer.count(bookstr)
+		if (config.minTokens > 0 && tokenCount < config.minTokens) || (config.maxTokens > 0 && tokenCount > config.maxTokens) {
+			logf("Skipping file %s, %d tokens is outside the token limits\n", name, tokenCount)
+			counters.skippedDueToTokenBudget++
+			return &bookResult{skipReason: skipTokenBudget}, nil
+		}
+	}
+
+	bookMeta := new(metadata)
+	bookMeta.title = book.Title
+	bookMeta.author = book.Metadata.Creator
+	bookMeta.publisher = book.Metadata.Publisher
+	bookMeta.language = book.Metadata.Language
+	bookMeta.description = book.Metadata.Description
+	bookMeta.filename = name
+	bookMeta.charCount = utf8.RuneCountInString(bookstr)
+	bookMeta.format = book.Metadata.Format
+	bookMeta.categories = []string{}
+	logf("Categories: %s\n", book.Metadata.Subject)
+	bookMeta.categories = append(bookMeta.categories, book.Metadata.Subject)
+	//parse seperated categories
+	if len(book.Metadata.Subject) > 0 && strings.Contains(book.Metadata.Subject, " -- ") {
+		bookMeta.categories = strings.Split(book.Metadata.Subject, " -- ")
+	}
+
+	bookMeta.identifier = book.Metadata.Identifier
+	bookMeta.relation = book.Metadata.Relation
+	bookMeta.coverage = book.Metadata.Coverage
+	bookMeta.rights = book.Metadata.Rights
+	bookMeta.quality = &quality
+	bookMeta.tokenCount = tokenCount
+	bookMeta.matterDropped = dropped
+	bookMeta.direction = direction
+	bookMeta.transcoded = transcoded
+	bookMeta.recovered = recovered
+	for _, stage := range cleaning.stats {
+		if stage.Repairs > 0 {
+			bookMeta.repairs = append(bookMeta.repairs, stage)
+		}
+	}
+	//the typography policy is applied by the normalize stage
+	bookMeta.typography = typographyPreserve
+	if pipelineHas(config.pipeline, "normalize") {
+		bookMeta.typography = config.typography
+	}
+
+	if config.skipCopyRight {
+		isRestricted := checkMetaForCopyright(*bookMeta)
+		if isRestricted {
+			if !config.silent {
+				logf("Skipping restricted book: %s (file: %s)\n", book.Title, name)
 			}
+			counters.skippedDueToCopyRight++
+			return &bookResult{meta: bookMeta, skipReason: skipCopyRight}, nil
+		}
+	}
 
+	//compare against the books seen so far, after cleaning so formatting differences don't matter
+	if config.dedup != nil {
+		if original := config.dedup.add(source, bookMeta, bookstr); original != "" {
+			logf("Book %s duplicates %s\n", source, original)
+			if config.dedup.mode == "skip" {
+				counters.skippedDueToDuplicate++
+				return &bookResult{meta: bookMeta, skipReason: skipDuplicate}, nil
+			}
 		}
+	}
 
+	counters.tokenCount += tokenCount
+	return &bookResult{meta: bookMeta, text: bookstr, side: side, rawCharCount: lenBefore, stages: cleaning.stats, audit: cleaning.audit, duration: time.Since(timeStart)}, nil
+}
+
+// buildOutputFilePath works out where a converted book is written, based on
+// the subset and folder options.
+func buildOutputFilePath(file fileTrack, bookMeta *metadata, outputdir string, config programConfig) string {
+	//if createSubsets is set to book, we don't change the output directory
+	//if it is set to author, we create a folder for each author
+	//if it is set to category, we create a folder for each category
+	//if it is set to categoryauthor, we create a folder for each category and then a folder for each author in that category
+
+	//generate output file name and file
+	outputFileName := strings.TrimSuffix(file.name, ".epub") + outputExtension(config)
+	outputFilePath := ""
+	seperateFoldersExtension := ""
+	if config.seperateFolders {
+		seperateFoldersExtension = strings.TrimSuffix(file.name, ".epub")
 	}
 
-	if counters.charCount > 0 {
-		counters.timeEnd = time.Now()
-		elapsed := counters.timeEnd.Sub(counters.timeStart)
-		fmt.Printf("--------------------\n")
-		fmt.Printf("Parsing took %s, parsed %d characters at a rate of %d characters per second.\n", elapsed, counters.charCount, int(float64(counters.charCount)/elapsed.Seconds()))
-		fmt.Printf("Cleaned %d characters, %% of characters removed: %f%%\n", counters.charCleanedCount, float64(counters.charCleanedCount)/float64(counters.charCount)*100)
-		fmt.Printf("Parsed %d books, %d finished and %d skipped due to copy right, %d skipped due to insufficient length after cleaning (2000 char).\n", counters.bookCount, counters.finishedBooksCount, counters.skippedDueToCopyRight, counters.skippedDueToInsuffcientLength)
+	if config.createSubsets == "book" {
+		outputFilePath = outputdir + "/" + seperateFoldersExtension + "/" + outputFileName
+	} else if config.createSubsets == "author" {
+		outputFilePath = outputdir + "/" + bookMeta.author + "/" + seperateFoldersExtension + "/" + outputFileName
+	} else if config.createSubsets == "category" {
+		outputFilePath = outputdir + "/" + bookMeta.categories[0] + "/" + seperateFoldersExtension + "/" + outputFileName
+	} else if config.createSubsets == "categoryauthor" {
+		outputFilePath = outputdir + "/" + bookMeta.categories[0] + "/" + bookMeta.author + "/" + seperateFoldersExtension + "/" + outputFileName
+	} else {
+		outputFilePath = outputdir + "/" + seperateFoldersExtension + "/" + outputFileName
+	}
+
+	//Fix for s3 - Remove spaces and replace with underscores, replace diacritics with ascii characters
+	reg, _ := regexp.Compile("\\s+")                           //compile
+	outputFilePath = reg.ReplaceAllString(outputFilePath, "_") //remove whitespaces
+	outputFilePath = strings.ReplaceAll(outputFilePath, "‘", "'")
+	outputFilePath = strings.ReplaceAll(outputFilePath, "’", "'")
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC) //remove diacritics, replace with ascii
+	outputFilePath, _, _ = transform.String(t, outputFilePath)
+	reg, _ = regexp.Compile("[^a-zA-Z0-9-_.':\\/]")            //compile
+	outputFilePath = reg.ReplaceAllString(outputFilePath, "_") //remove offending characters
+	return outputFilePath
+}
+
+// outputExtension is the file extension used for the configured output format.
+func outputExtension(config programConfig) string {
+	switch config.outputFormat {
+	case "json":
+		return ".json"
+	case "tokens":
+		return ".bin"
+	case "chunks":
+		return ".chunks.jsonl"
+	case "sentences":
+		return ".sentences.txt"
+	case "sentencesjson":
+		return ".sentences.jsonl"
+	}
+	return ".txt"
+}
+
+// renderBook produces the bytes written for a converted book in the configured
+// output format.
+func renderBook(result *bookResult, config programConfig) []byte {
+	if config.outputFormat == "tokens" {
+		return renderTokens(result, config)
+	}
+	if config.outputFormat == "chunks" {
+		return renderChunks(result, config)
+	}
+	if config.outputFormat == "sentences" || config.outputFormat == "sentencesjson" {
+		return renderSentences(result, config)
+	}
+	if config.outputFormat == "json" {
+		return appendJSONLine(nil, newBookRecord(result, config))
+	}
+
+	var sb strings.Builder
+	//write the book title and author to the top of the file if writeHeader is true
+	if config.writeHeader {
+		sb.WriteString(buildMetadataHeader(result.meta))
+	}
+	sb.WriteString(result.text)
+	return []byte(sb.String())
+}
+
+// appendJSONLine appends record to out as one line of json, as written by the
+// json, chunks and sentencesjson formats.
+func appendJSONLine(out []byte, record interface{}) []byte {
+	line, err := json.Marshal(record)
+	if err != nil {
+		//records only hold strings, numbers, maps and lists of them, so this can't happen
+		panic(err)
+	}
+	return append(append(out, line...), '\n')
+}
+
+// newBookRecord builds the json representation of a converted book.
+func newBookRecord(result *bookResult, config programConfig) bookRecord {
+	meta := result.meta
+	chapters := splitChapters(result.text)
+	return bookRecord{
+		Title:       meta.title,
+		Author:      meta.author,
+		Publisher:   meta.publisher,
+		Language:    meta.language,
+		Description: meta.description,
+		CharCount:   meta.charCount,
+		Filename:    meta.filename,
+		Identifier:  meta.identifier,
+		Categories:  meta.categories,
+		Format:      meta.format,
+		Relation:    meta.relation,
+		Coverage:    meta.coverage,
+		Rights:      meta.rights,
+		Typography:  meta.typography,
+		Direction:   meta.direction,
+		Recovered:   meta.recovered,
+		Quality:     meta.quality,
+		Stats: bookStats{
+			RawCharCount:  result.rawCharCount,
+			CharCount:     meta.charCount,
+			CharsRemoved:  result.rawCharCount - meta.charCount,
+			WordCount:     len(strings.Fields(result.text)),
+			ChapterCount:  len(chapters),
+			TokenCount:    meta.tokenCount,
+			DurationMs:    result.duration.Milliseconds(),
+			Stages:        result.stages,
+			MatterDropped: meta.matterDropped,
+			Transcoded:    meta.transcoded,
+		},
+		Chapters: chapters,
+		Side:     result.side,
+	}
+}
+
+// chapterHeaderRegex matches the chapter headers written by RemoveToCAndResolveChapterSeperators
+var chapterHeaderRegex = regexp.MustCompile(`(?m)^\*\*\*\n\[ Chapter (-?\d+): (.*) ; \]$`)
+
+// splitChapters splits cleaned text back into its chapters. Text without
+// chapter headers (e.g. when cleanOutput is off) comes back as one chapter.
+func splitChapters(text string) []chapterRecord {
+	chapters := []chapterRecord{}
+	headers := chapterHeaderRegex.FindAllStringSubmatchIndex(text, -1)
+	if len(headers) == 0 {
+		return append(chapters, chapterRecord{Index: 0, Text: strings.TrimSpace(text)})
+	}
+	//anything before the first header is kept as an untitled chapter
+	if preamble := strings.TrimSpace(text[:headers[0][0]]); preamble != "" {
+		chapters = append(chapters, chapterRecord{Index: 0, Text: preamble})
 	}
+	for i, header := range headers {
+		end := len(text)
+		if i+1 < len(headers) {
+			end = headers[i+1][0]
+		}
+		index, _ := strconv.Atoi(text[header[2]:header[3]])
+		chapters = append(chapters, chapterRecord{
+			Index: index,
+			Title: text[header[4]:header[5]],
+			Text:  strings.TrimSpace(text[header[1]:end]),
+		})
+	}
+	return chapters
 }
 
 // writeMetadataToFile writes the metadata of a book to a file.
@@ -428,7 +1248,7 @@ func writeMetadataToFile(bookMeta *metadata, outputdir string, config programCon
 		return
 	}
 	//generate output file name and file
-	outputFilePath := strings.TrimSuffix(outputdir, ".txt") + ".metadata"
+	outputFilePath := metadataFilePath(outputdir, config)
 
 	outputFile, err := os.Create(outputFilePath)
 	if err != nil {
@@ -439,11 +1259,53 @@ func writeMetadataToFile(bookMeta *metadata, outputdir string, config programCon
 	//write the book title and author to the top of the file if writeHeader is true
 	header := buildMetadataHeader(bookMeta)
 	outputFile.Write([]byte(header))
+	outputFile.Write([]byte("[ Typography: " + bookMeta.typography + "; ]\n"))
+	if bookMeta.direction != "" {
+		outputFile.Write([]byte("[ Direction: " + bookMeta.direction + "; ]\n"))
+	}
+	if len(bookMeta.repairs) > 0 {
+		repairs := "[ Repairs: "
+		for _, stage := range bookMeta.repairs {
+			repairs += fmt.Sprintf("%s=%d; ", stage.Stage, stage.Repairs)
+		}
+		outputFile.Write([]byte(repairs + "]\n"))
+	}
+	if len(bookMeta.recovered) > 0 {
+		outputFile.Write([]byte("[ Recovered: " + strings.Join(bookMeta.recovered, ", ") + "; ]\n"))
+	}
+	if len(bookMeta.transcoded) > 0 {
+		encodings := []string{}
+		for encoding, n := range bookMeta.transcoded {
+			encodings = append(encodings, fmt.Sprintf("%s=%d; ", encoding, n))
+		}
+		sort.Strings(encodings)
+		outputFile.Write([]byte("[ Transcoded: " + strings.Join(encodings, "") + "]\n"))
+	}
+	if len(bookMeta.matterDropped) > 0 {
+		matter := "[ Matter dropped: "
+		for _, class := range matterClasses {
+			if n := bookMeta.matterDropped[class]; n > 0 {
+				matter += fmt.Sprintf("%s=%d; ", class, n)
+			}
+		}
+		outputFile.Write([]byte(matter + "]\n"))
+	}
+	if bookMeta.quality != nil {
+		outputFile.Write([]byte(buildQualityLine(bookMeta.quality)))
+	}
+	if config.tokenizer != nil {
+		outputFile.Write([]byte(fmt.Sprintf("[ Tokens: %d; Tokenizer: %s; ]\n", bookMeta.tokenCount, filepath.Base(config.tokenizer.path))))
+	}
 	if outputFile != nil {
 		outputFile.Close()
 	}
 }
 
+// metadataFilePath is the path of the metadata file written next to a book.
+func metadataFilePath(outputFilePath string, config programConfig) string {
+	return strings.TrimSuffix(outputFilePath, outputExtension(config)) + ".metadata"
+}
+
 func countOpenFiles() int {
 	out, err := exec.Command("/bin/sh", "-c", fmt.Sprintf("lsof -p %v", os.Getpid())).Output()
 	if err != nil {
@@ -475,138 +1337,24 @@ func basicCleanString(input string) string {
 	input = strings.ReplaceAll(input, "\n\n", "\n")
 	input = strings.ReplaceAll(input, "\n\n", "\n")
 	input = strings.TrimFunc(input, func(r rune) bool {
-		return !unicode.IsGraphic(r)
+		//bidi controls at the ends set the direction of the first and last lines
+		return !unicode.IsGraphic(r) && !isBidiControl(r)
 	})
 
-	input = strings.ReplaceAll(input, " ", " ")
-
-	//replace left-right quotes with normal quotes
-	input = strings.ReplaceAll(input, "“", "\"")
-	input = strings.ReplaceAll(input, "”", "\"")
-	input = strings.ReplaceAll(input, "‘", "'")
-	input = strings.ReplaceAll(input, "’", "'")
 	return input
 }
 
-func gutenBergLineSubstitution(input string, config programConfig) []string {
+// gutenBergLineSubstitution marks the lines removed by the cleaning rules,
+// see rules.go. The default rules trim the common gutenberg headers and footers.
+func gutenBergLineSubstitution(input string, state *cleanState) []string {
 	//TRIM for gutenburg
-	if !config.gutenbergCleaning {
-		return []string{input}
-	}
-
 	lines := strings.Split(input, "\n")
 	lineCount := len(lines)
 	if lineCount == 0 {
 		fmt.Printf("No lines to clean\n")
 		return lines
 	}
-
-	if config.gutenbergCleaning {
-		//remove before Introduction and after Footnotes
-		if lineCount > 0 {
-			// Attempt to catch more chapters since epub is rarely 100% accurate
-			for _, line := range lines {
-				if strings.Contains(line, "Chapter") || strings.Contains(line, "CHAPTER") && line != "CHAPTER_SEPERATOR" {
-					line = "CHAPTER_SEPERATOR"
-				}
-			}
-
-			for i, line := range lines {
-				if strings.Contains(line, "\"Cover\"") && i < 10 {
-					lines = markLinesBeforeForDeletion(lines, i+1)
-					break
-				}
-			}
-			for i, line := range lines {
-				if (strings.Contains(line, "Introduction") || strings.Contains(line, "Introduction.") || strings.Contains(line, "INTRODUCTION")) && i < 100 {
-					lines = markLinesBeforeForDeletion(lines, i+1)
-					break
-				}
-			}
-			for i, line := range lines {
-				if (strings.Contains(line, "Introduction") || strings.Contains(line, "Introduction.")) && i < 100 {
-					lines = markLinesBeforeForDeletion(lines, i+1)
-					break
-				}
-			}
-
-			for i, line := range lines {
-				if strings.Contains(line, "Bibliography") || strings.Contains(line, "BIBLIOGRAPHY.") && i < 100 {
-					lines = markLinesBeforeForDeletion(lines, i+1)
-					break
-				}
-			}
-
-			for i, line := range lines {
-				if (strings.Contains(line, "Part One") || strings.Contains(line, "PART ONE")) && i < 50 {
-					lines = markLinesBeforeForDeletion(lines, i+2)
-					break
-				}
-			}
-
-			for i, line := range lines {
-				if (strings.Contains(line, "Contents") || strings.Contains(line, "CONTENTS")) && i < 50 {
-					lines = markLinesBeforeForDeletion(lines, i+3)
-					break
-				}
-			}
-
-			for i, line := range lines {
-				if strings.Contains(line, "PREFACE") && i < 200 {
-					lines = markLinesBeforeForDeletion(lines, i)
-					break
-				}
-			}
-
-			for i, line := range lines {
-				if (strings.Contains(line, "START OF THE PROJECT GUTENBERG EBOOK") || strings.Contains(line, "The Project Gutenberg EBook")) && i < 150 {
-					lines = markLinesBeforeForDeletion(lines, i+1)
-					break
-				}
-			}
-
-			// Some books have endings at the start strangely
-			for i, line := range lines {
-				linePercent := float64(i) / float64(lineCount)
-				if strings.Contains(line, "Footnotes") && linePercent > 0.8 {
-					lines = markLinesAfterForDeletion(lines, i)
-					break
-				}
-			}
-
-			for i, line := range lines {
-				linePercent := float64(i) / float64(lineCount)
-				if strings.Contains(line, "END OF THE PROJECT GUTENBERG EBOOK") && linePercent > 0.3 {
-					lines = markLinesAfterForDeletion(lines, i)
-					break
-				}
-			}
-
-			for i, line := range lines {
-				if strings.Contains(line, "APPENDIX") {
-					lines = markLinesAfterForDeletion(lines, i)
-					break
-				}
-			}
-
-			//remove any line that has [Pages or [Page, just remove that line
-			for i, line := range lines {
-				if strings.Contains(line, "[Pages") || strings.Contains(line, "[Page") || strings.Contains(line, "[pg") {
-					lines = markLineForDeletion(lines, i)
-				}
-			}
-
-			//remove any line that has Gutenberg
-			for i, line := range lines {
-				if strings.Contains(line, "Gutenberg") {
-					lines = markLineForDeletion(lines, i)
-				}
-			}
-		}
-	} else {
-		return lines
-	}
-	return lines
+	return applyCleaningRules(lines, state.config.rules, state.audit)
 }
 
 func resolveAllMarks(lines []string) []string {
@@ -615,6 +1363,9 @@ func resolveAllMarks(lines []string) []string {
 			lines[i] = ""
 		}
 	}
+	if len(lines) < 2 {
+		return lines[:0]
+	}
 	return lines[:len(lines)-2]
 }
 
@@ -634,7 +1385,7 @@ func cleanLineList(lines []string) []string {
 	return CleanedLines
 }
 
-func RemoveToCAndResolveChapterSeperators(lines []string, thresholdRemove int, rangeRemove int) string {
+func RemoveToCAndResolveChapterSeperators(lines []string, thresholdRemove int, rangeRemove int, audit *cleanAudit) string {
 	offset := 0
 	//if book does not have chapter seperator in first 10 lines, add it
 	for i, line := range lines {
@@ -656,7 +1407,18 @@ func RemoveToCAndResolveChapterSeperators(lines []string, thresholdRemove int, r
 	totalChapterCount := len(bookByChapters)
 	story := ""
 
+	//record dropped chapters in the audit
+	position := 0
+	chapterStart := 0
+	dropped := func(rule string, chapter string) {
+		if audit != nil {
+			audit.add(rule, strings.Count(storyBuffer[:chapterStart], "\n"), chapterStart, chapter)
+		}
+	}
+
 	for _, chapter := range bookByChapters {
+		chapterStart = position
+		position += len(chapter) + len("CHAPTER_SEPERATOR")
 		//only check first thresholdRemove and last thresholdRemove chapters
 		chapterTitle := ""
 		if chapterCount > thresholdRemove && chapterCount < totalChapterCount-thresholdRemove {
@@ -685,6 +1447,8 @@ func RemoveToCAndResolveChapterSeperators(lines []string, thresholdRemove int, r
 				story += fmt.Sprintf("\n***\n[ Chapter %d: %s ; ]\n", chapterCount-offset, chapterTitle)
 				story += chapter
 				chapterCount++
+			} else {
+				dropped("short chapter", chapter)
 			}
 			continue
 		}
@@ -705,6 +1469,7 @@ func RemoveToCAndResolveChapterSeperators(lines []string, thresholdRemove int, r
 		}
 		//add chapter to story if it is not a chapter list
 		if numbers > rangeRemove && len(chapter) < 10000 {
+			dropped("contents list", chapter)
 			offset++
 		} else if len(chapter_nopunct) > 30 {
 			//grab title if it exists
@@ -728,41 +1493,18 @@ func RemoveToCAndResolveChapterSeperators(lines []string, thresholdRemove int, r
 			story += fmt.Sprintf("\n***\n[ Chapter %d: %s ; ]\n", chapterCount-offset, chapterTitle)
 			story += chapter
 			chapterCount++
+		} else {
+			dropped("short chapter", chapter)
 		}
 
 	}
 	return story
 }
 
-func cleanEpubString(input string, config programConfig) string {
-	//first pass to make it a bit more readable
-	input = basicCleanString(input)
-	if !config.cleanOutput {
-		input = strings.Replace(input, "PARAGRAPH", "\n", -1)
-		input = strings.Replace(input, "HEADER!", "\n", -1)
-		input = strings.Replace(input, "CHAPTER_SEPERATOR", "\n", -1)
-		return input
-	}
-
-	//special gutenburg cleaning if enabled (trimming based on common gutenburg headers and footers)
-	CleanedLines := []string{}
-	if config.gutenbergCleaning {
-		CleanedLines = gutenBergLineSubstitution(input, config)
-		CleanedLines = resolveAllMarks(CleanedLines)
-	} else {
-		CleanedLines = cleanLineList(strings.Split(input, "\n"))
-	}
-
-	//resolve the paragraph and header marks from <p> tags
-
-	storyBuffer := strings.Join(CleanedLines, " ")
-	storyBuffer = strings.Replace(storyBuffer, "PARAGRAPH", "\n", -1)
-
-	CleanedLines = cleanLineList(strings.Split(storyBuffer, "\n"))
-	//CleanedLines = strings.Split(storyBuffer, "\n")
-	story := RemoveToCAndResolveChapterSeperators(CleanedLines, 20, 15)
-	story = strings.Replace(story, "HEADER!", "", -1)
-	return story
+// cleanEpubString runs the cleaning pipeline over the parser output, see
+// pipeline.go.
+func cleanEpubString(input string, config programConfig) (string, *cleanState) {
+	return runPipeline(input, config)
 }
 
 func markLineForDeletion(s []string, index int) []string {
@@ -795,11 +1537,14 @@ func RemoveIndex(s []string, index int) []string {
 
 // parseText takes in html content via an io.Reader and returns a buffer
 // containing only plain text.
-func parseText(r io.Reader, items []epub.Item, sb strings.Builder) (strings.Builder, error) {
+func parseText(r io.Reader, items []epub.Item, sb strings.Builder, opts parseOptions) (strings.Builder, error) {
 	tokenizer := html.NewTokenizer(r)
 	doc := cellbuf{width: 80}
-	p := parser{tokenizer: tokenizer, doc: doc, items: items, sb: sb}
+	p := parser{tokenizer: tokenizer, doc: doc, items: items, sb: sb, opts: opts, sideDepth: -1}
 	err := p.parse(r)
+	if opts.side != nil {
+		*opts.side = append(*opts.side, p.side...)
+	}
 	if err != nil {
 		return p.sb, err
 	}
@@ -815,14 +1560,35 @@ func (p *parser) parse(io.Reader) (err error) {
 		case html.ErrorToken:
 			err = p.tokenizer.Err()
 		case html.StartTagToken:
-			p.tagStack = append(p.tagStack, token.DataAtom) // push element
-			fallthrough
+			p.tagStack = append(p.tagStack, elementAtom(token)) // push element
+			if p.skipStartTag(token, false) {
+				p.hintStack = append(p.hintStack, "")
+				p.dirStack = append(p.dirStack, dirEntry{})
+			} else {
+				p.startHints(token)
+				p.startRuby(p.tagStack[len(p.tagStack)-1])
+				p.handleStartTag(token)
+				p.startDir(token)
+			}
 		case html.SelfClosingTagToken:
-			p.handleStartTag(token)
+			if !p.skipStartTag(token, true) {
+				p.handleStartTag(token)
+			}
 		case html.TextToken:
-			p.handleText(token)
+			if !p.skipping() {
+				p.handleText(token)
+			}
 		case html.EndTagToken:
-			p.tagStack = p.tagStack[:len(p.tagStack)-1] // pop element
+			if !p.skipping() && len(p.tagStack) > 0 {
+				p.endRuby(p.tagStack[len(p.tagStack)-1])
+			}
+			p.endDir()
+			p.skipEndTag(token)
+			p.endHints()
+			p.endSideText()
+			if len(p.tagStack) > 0 {
+				p.tagStack = p.tagStack[:len(p.tagStack)-1] // pop element
+			}
 		}
 		if err == io.EOF {
 			return nil
@@ -835,14 +1601,27 @@ func (p *parser) parse(io.Reader) (err error) {
 // handleText appends text elements to the parser buffer. It filters elements
 // that should not be displayed as text (e.g. style blocks).
 func (p *parser) handleText(token html.Token) {
-	// Skip style tags
-	if len(p.tagStack) > 0 && p.tagStack[len(p.tagStack)-1] == atom.Style {
+	// Read the rules of style tags when css is on
+	if len(p.tagStack) > 0 && p.tagStack[len(p.tagStack)-1] == atom.Style && p.opts.css {
+		p.sheets = append(p.sheets, parseStyleSheet(token.Data))
+	}
+	text := token.Data
+	if p.opts.bidi == bidiNormalize {
+		text = stripBidiControls(text)
+	}
+	// Skip or set aside the text of elements that aren't prose
+	switch policy, depth := p.textPolicy(); policy {
+	case elementSkip:
+		return
+	case elementSide:
+		p.addSideText(text, depth)
 		return
 	}
+	text = p.markDirection(text)
 	p.doc.style(p.tagStack)
 	//I think the appendText is needed to properly parse the tags
-	p.doc.appendText(string(token.Data))
-	p.sb.WriteString(string(token.Data))
+	p.doc.appendText(text)
+	p.sb.WriteString(text)
 
 }
 
@@ -872,6 +1651,12 @@ func (p *parser) handleStartTag(token html.Token) {
 	case atom.Br:
 		p.doc.row++
 		p.doc.col = p.doc.lmargin
+		//keep the lines of poems
+		if p.inVerse() {
+			p.sb.WriteString("PARAGRAPH")
+		}
+	case atom.Link:
+		p.linkStyleSheet(token)
 	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Title,
 		atom.Div, atom.Tr:
 		p.doc.row += 2
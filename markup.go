@@ -0,0 +1,204 @@
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// parseOptions change what the parser leaves out of a document
+type parseOptions struct {
+	//keepMatter are the matter classes kept, nil keeps all
+	keepMatter map[string]bool
+	//sections classifies elements of the document by id, see loadBookMatter
+	sections map[string]string
+	//dropped counts the sections left out per matter class
+	dropped map[string]int
+	//css turns on the visibility rules and class hints, see css.go
+	css bool
+	//docPath is the path of the document in the archive and styleSheets the
+	//stylesheets of the book, by path
+	docPath     string
+	styleSheets map[string]*styleSheet
+	//elementPolicy decides what happens to the text of each element, see
+	//defaultElementPolicy. side collects the text routed to the side channel.
+	elementPolicy map[atom.Atom]string
+	side          *[]sideText
+	//ruby is the -ruby mode, see cjk.go
+	ruby string
+	//bidi is the -bidi mode and direction the direction of the book, set by
+	//the first document with a dir when the spine has none, see bidi.go
+	bidi      string
+	direction *string
+}
+
+// voidElements have no end tag, so they are never skipped past their start
+// tag even when the book leaves out the closing slash
+var voidElements = map[atom.Atom]bool{
+	atom.Area: true, atom.Base: true, atom.Br: true, atom.Col: true, atom.Embed: true,
+	atom.Hr: true, atom.Img: true, atom.Input: true, atom.Link: true, atom.Meta: true,
+	atom.Param: true, atom.Source: true, atom.Track: true, atom.Wbr: true,
+}
+
+// headingLevels are the levels of the heading elements
+var headingLevels = map[atom.Atom]int{
+	atom.H1: 1, atom.H2: 2, atom.H3: 3, atom.H4: 4, atom.H5: 5, atom.H6: 6,
+}
+
+// attrHasWord reports whether the attribute key of token holds word in its
+// space separated list of values, as class, role and epub:type do.
+func attrHasWord(token html.Token, key string, word string) bool {
+	for _, a := range token.Attr {
+		if a.Key == key && hasWord(a.Val, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// attrValue returns the value of the attribute key of token.
+func attrValue(token html.Token, key string) string {
+	for _, a := range token.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// isPageMarker reports whether the element marks a page of the printed
+// edition: epub:type="pagebreak", role="doc-pagebreak" or the pagenum class
+// Gutenberg puts around "[Pg 12]".
+func isPageMarker(token html.Token) bool {
+	return attrHasWord(token, "epub:type", "pagebreak") ||
+		attrHasWord(token, "role", "doc-pagebreak") ||
+		attrHasWord(token, "class", "pagenum")
+}
+
+// skipping reports whether the parser is inside a part it leaves out.
+func (p *parser) skipping() bool {
+	return p.skipDepth > 0 || p.headingSkip > 0
+}
+
+// skipStartTag reports whether the parser leaves out the element, with its
+// text, up to its end tag. Only the element is left out, the text around it
+// is kept. A heading of a section that isn't kept leaves out everything up to
+// the next heading of the same or a higher level, or the end of its parent.
+func (p *parser) skipStartTag(token html.Token, selfClosing bool) bool {
+	if p.skipDepth > 0 {
+		if !selfClosing && token.Data == p.skipName {
+			p.skipDepth++
+		}
+		return true
+	}
+	if p.headingSkip > 0 {
+		if level := headingLevels[token.DataAtom]; level == 0 || level > p.headingSkip {
+			return true
+		}
+		p.headingSkip = 0
+	}
+
+	if isPageMarker(token) || (p.opts.css && isHidden(token, p.sheets)) {
+		p.skipElement(token, selfClosing)
+		return true
+	}
+	class, bySection := p.opts.sections[attrValue(token, "id")]
+	if !bySection {
+		class = elementMatter(token)
+	}
+	if class == "" && p.opts.css && elementHint(token) == hintNotes {
+		class = "notes"
+	}
+	if keepsMatter(p.opts.keepMatter, class) {
+		return false
+	}
+	if p.opts.dropped != nil {
+		p.opts.dropped[class]++
+	}
+	if level := headingLevels[token.DataAtom]; bySection && level > 0 && !selfClosing {
+		p.headingSkip, p.headingDepth = level, len(p.tagStack)-1
+		return true
+	}
+	p.skipElement(token, selfClosing)
+	return true
+}
+
+// skipElement leaves out the element up to its end tag.
+func (p *parser) skipElement(token html.Token, selfClosing bool) {
+	if !selfClosing && !voidElements[token.DataAtom] {
+		p.skipName, p.skipDepth = token.Data, 1
+	}
+}
+
+// skipEndTag ends the skipped element at its end tag, and a skipped section
+// at the end of its parent.
+func (p *parser) skipEndTag(token html.Token) {
+	if p.skipDepth > 0 {
+		if token.Data == p.skipName {
+			p.skipDepth--
+		}
+		return
+	}
+	if p.headingSkip > 0 && len(p.tagStack) <= p.headingDepth {
+		p.headingSkip = 0
+	}
+}
+
+// startHints follows the class hints of an element that starts, see
+// semanticClasses. A chapter starts a new chapter unless it opens the
+// document. It runs before handleStartTag, so the chapter starts before the
+// header mark of its element.
+func (p *parser) startHints(token html.Token) {
+	if token.DataAtom == atom.Body {
+		p.bodyStart = p.sb.Len()
+	}
+	hint := ""
+	if p.opts.css {
+		hint = elementHint(token)
+	}
+	p.hintStack = append(p.hintStack, hint)
+	switch hint {
+	case hintChapter:
+		if strings.TrimSpace(markReplacer.Replace(p.sb.String()[p.bodyStart:])) != "" {
+			p.sb.WriteString("CHAPTER_SEPERATOR")
+		}
+	case hintBlock:
+		p.sb.WriteString("PARAGRAPH")
+	}
+}
+
+// endHints closes the hints of an element that ends. Verse and blocks are
+// set apart from the text after them.
+func (p *parser) endHints() {
+	if len(p.hintStack) == 0 {
+		return
+	}
+	hint := p.hintStack[len(p.hintStack)-1]
+	p.hintStack = p.hintStack[:len(p.hintStack)-1]
+	if (hint == hintVerse || hint == hintBlock) && !p.skipping() {
+		p.sb.WriteString("PARAGRAPH")
+	}
+}
+
+// inVerse reports whether the parser is inside verse, where line breaks are
+// kept.
+func (p *parser) inVerse() bool {
+	for _, hint := range p.hintStack {
+		if hint == hintVerse {
+			return true
+		}
+	}
+	return false
+}
+
+// linkStyleSheet adds the stylesheet a <link> points to.
+func (p *parser) linkStyleSheet(token html.Token) {
+	if !p.opts.css || !hasWord(strings.ToLower(attrValue(token, "rel")), "stylesheet") {
+		return
+	}
+	sheetPath, _ := resolveHREF(p.opts.docPath, attrValue(token, "href"))
+	if sheet, ok := p.opts.styleSheets[sheetPath]; ok {
+		p.sheets = append(p.sheets, sheet)
+	}
+}
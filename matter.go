@@ -0,0 +1,174 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// matterClasses are the classes a spine item or section can be given, see
+// -keepMatter
+var matterClasses = []string{"cover", "titlepage", "copyright", "toc", "frontmatter", "bodymatter", "backmatter", "notes", "index", "colophon"}
+
+// matterTypes maps epub:type values, DPUB-ARIA roles without their doc-
+// prefix and EPUB2 guide types to matter classes
+var matterTypes = map[string]string{
+	"cover": "cover",
+
+	"titlepage": "titlepage", "title-page": "titlepage", "halftitlepage": "titlepage",
+
+	"copyright-page": "copyright",
+
+	"toc": "toc", "landmarks": "toc", "loi": "toc", "lot": "toc", "page-list": "toc",
+
+	"frontmatter": "frontmatter", "dedication": "frontmatter", "epigraph": "frontmatter",
+	"foreword": "frontmatter", "preface": "frontmatter", "introduction": "frontmatter",
+	"acknowledgments": "frontmatter", "acknowledgements": "frontmatter", "seriespage": "frontmatter",
+	"imprimatur": "frontmatter", "contributors": "frontmatter", "other-credits": "frontmatter",
+	"errata": "frontmatter",
+
+	"bodymatter": "bodymatter", "text": "bodymatter", "chapter": "bodymatter", "part": "bodymatter",
+	"volume": "bodymatter", "prologue": "bodymatter", "epilogue": "bodymatter", "conclusion": "bodymatter",
+
+	"backmatter": "backmatter", "afterword": "backmatter", "appendix": "backmatter",
+	"glossary": "backmatter", "bibliography": "backmatter",
+
+	"notes": "notes", "endnotes": "notes", "rearnotes": "notes", "footnotes": "notes",
+
+	"index": "index",
+
+	"colophon": "colophon",
+}
+
+// parseMatterClasses parses the -keepMatter list. "all" keeps every class and
+// comes back as nil.
+func parseMatterClasses(spec string) (map[string]bool, error) {
+	if strings.TrimSpace(spec) == "all" {
+		return nil, nil
+	}
+	keep := make(map[string]bool)
+	for _, class := range strings.Split(spec, ",") {
+		class = strings.TrimSpace(class)
+		if class == "" {
+			continue
+		}
+		known := false
+		for _, c := range matterClasses {
+			known = known || c == class
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown matter class %q, classes are: all, %s", class, strings.Join(matterClasses, ", "))
+		}
+		keep[class] = true
+	}
+	return keep, nil
+}
+
+// keepsMatter reports whether text of the class is kept. Unclassified text is
+// always kept.
+func keepsMatter(keep map[string]bool, class string) bool {
+	return keep == nil || class == "" || keep[class]
+}
+
+// elementMatter returns the matter class of an element from its epub:type or
+// role, or "" when it has none.
+func elementMatter(token html.Token) string {
+	for _, a := range token.Attr {
+		if a.Key != "epub:type" && a.Key != "role" {
+			continue
+		}
+		for _, value := range strings.Fields(a.Val) {
+			if class, ok := matterTypes[strings.TrimPrefix(value, "doc-")]; ok {
+				return class
+			}
+		}
+	}
+	return ""
+}
+
+// bookMatter is the classification of the documents of a book, by path in
+// the archive, and of the sections of a document, by element id
+type bookMatter struct {
+	documents map[string]string
+	sections  map[string]map[string]string
+}
+
+// loadBookMatter classifies the documents and sections of a book from the
+// EPUB2 guide and the EPUB3 landmarks nav. A reference with a fragment
+// classifies the element with that id, one without the whole document.
+// A landmarks nav that can't be read only means less is classified.
+func loadBookMatter(z *zip.Reader, opfPath string, pkg *opfPackage) bookMatter {
+	matter := bookMatter{documents: make(map[string]string), sections: make(map[string]map[string]string)}
+	add := func(base string, href string, kind string) {
+		class, ok := matterTypes[strings.TrimPrefix(kind, "doc-")]
+		if !ok {
+			return
+		}
+		doc, fragment := resolveHREF(base, href)
+		if fragment == "" {
+			matter.documents[doc] = class
+			return
+		}
+		if matter.sections[doc] == nil {
+			matter.sections[doc] = make(map[string]string)
+		}
+		matter.sections[doc][fragment] = class
+	}
+
+	for _, reference := range pkg.Guide {
+		add(opfPath, reference.HREF, reference.Type)
+	}
+	for _, item := range pkg.Items {
+		if !hasWord(item.Properties, "nav") {
+			continue
+		}
+		navPath, _ := resolveHREF(opfPath, item.HREF)
+		nav, err := readZipFile(z, navPath)
+		if err != nil {
+			continue
+		}
+		for _, landmark := range readLandmarks(nav) {
+			add(navPath, landmark[1], landmark[0])
+		}
+	}
+	return matter
+}
+
+// readLandmarks returns the epub:type and href of the links in the landmarks
+// nav of a navigation document.
+func readLandmarks(nav []byte) [][2]string {
+	landmarks := [][2]string{}
+	tokenizer := html.NewTokenizer(strings.NewReader(string(nav)))
+	depth := 0
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			return landmarks
+		}
+		token := tokenizer.Token()
+		switch {
+		case tokenType == html.StartTagToken && token.DataAtom == atom.Nav:
+			if depth > 0 || attrHasWord(token, "epub:type", "landmarks") {
+				depth++
+			}
+		case tokenType == html.EndTagToken && token.DataAtom == atom.Nav && depth > 0:
+			depth--
+		case tokenType == html.StartTagToken && token.DataAtom == atom.A && depth > 0:
+			kind, href := "", ""
+			for _, a := range token.Attr {
+				switch a.Key {
+				case "epub:type":
+					kind = a.Val
+				case "href":
+					href = a.Val
+				}
+			}
+			for _, value := range strings.Fields(kind) {
+				landmarks = append(landmarks, [2]string{value, href})
+			}
+		}
+	}
+}
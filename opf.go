@@ -0,0 +1,139 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/taylorskalyo/goreader/epub"
+)
+
+// Ways to treat spine items marked linear="no", see -nonLinear
+const (
+	nonLinearAppend = "append"
+	nonLinearDrop   = "drop"
+	nonLinearInline = "inline"
+)
+
+// contentMediaTypes are the media types of spine items that hold text
+var contentMediaTypes = map[string]bool{
+	"application/xhtml+xml": true,
+	"text/html":             true,
+	"text/x-oeb1-document":  true,
+}
+
+// opfPackage holds the parts of the package document goreader leaves out
+type opfPackage struct {
+	Items []opfItem `xml:"manifest>item"`
+	Spine struct {
+		Direction string       `xml:"page-progression-direction,attr"`
+		Itemrefs  []opfItemref `xml:"itemref"`
+	} `xml:"spine"`
+	Guide []struct {
+		Type string `xml:"type,attr"`
+		HREF string `xml:"href,attr"`
+	} `xml:"guide>reference"`
+}
+
+// opfItem is a file of the manifest
+type opfItem struct {
+	ID         string `xml:"id,attr"`
+	HREF       string `xml:"href,attr"`
+	MediaType  string `xml:"media-type,attr"`
+	Properties string `xml:"properties,attr"`
+}
+
+// opfItemref is a document of the spine, by the id of its manifest item
+type opfItemref struct {
+	IDREF  string `xml:"idref,attr"`
+	Linear string `xml:"linear,attr"`
+}
+
+// spineDoc is a document of the spine that is converted
+type spineDoc struct {
+	id     string
+	path   string
+	linear bool
+}
+
+// readZipFile reads a file from the archive.
+func readZipFile(z *zip.Reader, name string) ([]byte, error) {
+	f, err := z.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// resolveHREF turns an href found in the file at base into a path in the
+// archive and a fragment.
+func resolveHREF(base string, href string) (string, string) {
+	href, fragment, _ := strings.Cut(href, "#")
+	if unescaped, err := url.PathUnescape(href); err == nil {
+		href = unescaped
+	}
+	if href == "" {
+		return base, fragment
+	}
+	return path.Join(path.Dir(base), href), fragment
+}
+
+// readPackage reads the package document at opfPath, and the goreader
+// rootfile that holds its metadata.
+func readPackage(z *zip.Reader, opfPath string) (*opfPackage, *epub.Rootfile, error) {
+	data, err := readZipFile(z, opfPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	pkg := &opfPackage{}
+	if err := xml.Unmarshal(data, pkg); err != nil {
+		return nil, nil, err
+	}
+	book := &epub.Rootfile{FullPath: opfPath}
+	if err := xml.Unmarshal(data, &book.Package); err != nil {
+		return nil, nil, err
+	}
+	return pkg, book, nil
+}
+
+// spineDocs lists the documents of the spine in reading order. Navigation
+// documents and items that aren't (X)HTML are left out. Items marked
+// linear="no", like pop-up notes and answer keys, are moved to the end, left
+// out or kept in place following nonLinear.
+func spineDocs(pkg *opfPackage, opfPath string, nonLinear string) []spineDoc {
+	docs, appended := []spineDoc{}, []spineDoc{}
+	for _, itemref := range pkg.Spine.Itemrefs {
+		for _, item := range pkg.Items {
+			if item.ID != itemref.IDREF {
+				continue
+			}
+			if hasWord(item.Properties, "nav") || !contentMediaTypes[item.MediaType] {
+				break
+			}
+			docPath, _ := resolveHREF(opfPath, item.HREF)
+			doc := spineDoc{id: item.ID, path: docPath, linear: itemref.Linear != "no"}
+			switch {
+			case doc.linear || nonLinear == nonLinearInline:
+				docs = append(docs, doc)
+			case nonLinear == nonLinearAppend:
+				appended = append(appended, doc)
+			}
+			break
+		}
+	}
+	return append(docs, appended...)
+}
+
+// hasWord reports whether the space separated list holds word.
+func hasWord(list string, word string) bool {
+	for _, value := range strings.Fields(list) {
+		if value == word {
+			return true
+		}
+	}
+	return false
+}
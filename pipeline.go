@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Cleaner is one stage of the cleaning pipeline. Stages work on the parser
+// output, which still holds the PARAGRAPH, HEADER! and CHAPTER_SEPERATOR
+// marks until the stage that resolves them.
+type Cleaner interface {
+	Name() string
+	Clean(input string, state *cleanState) string
+}
+
+// cleanState is shared by the stages cleaning one book. audit is nil unless
+// -audit is set. repairs counts the fixes of the running stage, see
+// repair.go.
+type cleanState struct {
+	config  programConfig
+	stats   []stageStat
+	audit   *cleanAudit
+	words   map[string]int
+	repairs int
+}
+
+// stageStat is the time taken and the characters removed by one stage
+type stageStat struct {
+	Stage        string        `json:"stage"`
+	CharsRemoved int           `json:"charsRemoved"`
+	Repairs      int           `json:"repairs,omitempty"`
+	Duration     time.Duration `json:"-"`
+	DurationMs   float64       `json:"durationMs"`
+}
+
+// cleanerFunc turns a function into a Cleaner
+type cleanerFunc struct {
+	name string
+	fn   func(input string, state *cleanState) string
+}
+
+func (c cleanerFunc) Name() string { return c.name }
+
+func (c cleanerFunc) Clean(input string, state *cleanState) string { return c.fn(input, state) }
+
+// cleaners are the available stages, in the order they are normally run
+var cleaners = []Cleaner{
+	cleanerFunc{"mojibake", mojibakeStage},
+	cleanerFunc{"normalize", normalizeStage},
+	cleanerFunc{"gutenberg", gutenbergStage},
+	cleanerFunc{"dehyphenate", dehyphenateStage},
+	cleanerFunc{"dropcaps", dropCapsStage},
+	cleanerFunc{"paragraphs", paragraphsStage},
+	cleanerFunc{"toc", tocStage},
+}
+
+// lookupCleaner finds a stage by name.
+func lookupCleaner(name string) (Cleaner, bool) {
+	for _, c := range cleaners {
+		if c.Name() == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// cleanerNames lists the names of the available stages.
+func cleanerNames() []string {
+	names := make([]string, len(cleaners))
+	for i, c := range cleaners {
+		names[i] = c.Name()
+	}
+	return names
+}
+
+// buildPipeline turns a comma separated list of stage names into a pipeline.
+// The toc stage works on whole paragraphs, so paragraphs is added before it
+// when it isn't listed.
+func buildPipeline(spec string) ([]Cleaner, error) {
+	pipeline := []Cleaner{}
+	hasParagraphs := false
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		c, ok := lookupCleaner(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown pipeline stage %q, stages are: %s", name, strings.Join(cleanerNames(), ", "))
+		}
+		if name == "paragraphs" {
+			hasParagraphs = true
+		}
+		if name == "toc" && !hasParagraphs {
+			paragraphs, _ := lookupCleaner("paragraphs")
+			pipeline = append(pipeline, paragraphs)
+			hasParagraphs = true
+		}
+		pipeline = append(pipeline, c)
+	}
+	return pipeline, nil
+}
+
+// defaultPipeline is the pipeline used when -pipeline isn't given, following
+// -cleanOutput and -gutenbergCleaning.
+func defaultPipeline(cleanOutput bool, gutenbergCleaning bool) string {
+	if !cleanOutput {
+		return "normalize"
+	}
+	if gutenbergCleaning {
+		return "normalize,gutenberg,paragraphs,toc"
+	}
+	return "normalize,paragraphs,toc"
+}
+
+// pipelineHas reports whether the pipeline contains the named stage.
+func pipelineHas(pipeline []Cleaner, name string) bool {
+	for _, c := range pipeline {
+		if c.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// pipelineString formats a pipeline for printing.
+func pipelineString(pipeline []Cleaner) string {
+	names := make([]string, len(pipeline))
+	for i, c := range pipeline {
+		names[i] = c.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+// resolveMarks turns the marks left after the last stage into line breaks.
+// It always runs, and is reported as the "marks" stage.
+var resolveMarks = cleanerFunc{"marks", func(input string, state *cleanState) string {
+	input = strings.Replace(input, "PARAGRAPH", "\n", -1)
+	input = strings.Replace(input, "HEADER!", "\n", -1)
+	return strings.Replace(input, "CHAPTER_SEPERATOR", "\n", -1)
+}}
+
+// runPipeline runs the configured stages over the parser output.
+func runPipeline(input string, config programConfig) (string, *cleanState) {
+	state := &cleanState{config: config}
+	if config.audit != "off" {
+		state.audit = newCleanAudit(input, config)
+	}
+	stages := append(append([]Cleaner{}, config.pipeline...), resolveMarks)
+	state.stats = make([]stageStat, 0, len(stages))
+	for _, c := range stages {
+		if state.audit != nil {
+			state.audit.stage = c.Name()
+		}
+		state.repairs = 0
+		start := time.Now()
+		before := utf8.RuneCountInString(input)
+		input = c.Clean(input, state)
+		elapsed := time.Since(start)
+		state.stats = append(state.stats, stageStat{
+			Stage:        c.Name(),
+			CharsRemoved: before - utf8.RuneCountInString(input),
+			Repairs:      state.repairs,
+			Duration:     elapsed,
+			DurationMs:   float64(elapsed.Microseconds()) / 1000,
+		})
+	}
+	return input, state
+}
+
+// addStageStats adds the stage statistics of a book to the run totals.
+func (counters *programCounter) addStageStats(stats []stageStat) {
+	for _, stat := range stats {
+		found := false
+		for i := range counters.stages {
+			if counters.stages[i].Stage == stat.Stage {
+				counters.stages[i].CharsRemoved += stat.CharsRemoved
+				counters.stages[i].Repairs += stat.Repairs
+				counters.stages[i].Duration += stat.Duration
+				found = true
+				break
+			}
+		}
+		if !found {
+			counters.stages = append(counters.stages, stat)
+		}
+	}
+}
+
+// normalizeStage applies the typography policy and fixes whitespace, see
+// applyTypography and basicCleanString.
+func normalizeStage(input string, state *cleanState) string {
+	//legacy replaces after fixing whitespace, as the converter always did
+	if state.config.typography == typographyLegacy {
+		return applyTypography(basicCleanString(input), typographyLegacy)
+	}
+	return basicCleanString(applyTypography(input, state.config.typography))
+}
+
+// gutenbergStage removes the lines matched by the cleaning rules.
+func gutenbergStage(input string, state *cleanState) string {
+	lines := gutenBergLineSubstitution(input, state)
+	if state.audit != nil && len(lines) > 0 {
+		//resolveAllMarks drops the last two lines
+		offsets := lineOffsets(strings.Split(input, "\n"))
+		for i := len(lines) - 2; i < len(lines); i++ {
+			if i >= 0 && lines[i] != "MARKED_FOR_DELETION" {
+				state.audit.add("last lines", i, offsets[i], lines[i])
+			}
+		}
+	}
+	return strings.Join(resolveAllMarks(lines), "\n")
+}
+
+// paragraphsStage joins the lines of each paragraph and resolves the
+// paragraph marks from <p> tags. Lines of Chinese and Japanese text are
+// joined without spaces, see joinLines.
+func paragraphsStage(input string, state *cleanState) string {
+	storyBuffer := joinLines(cleanLineList(strings.Split(input, "\n")))
+	storyBuffer = strings.Replace(storyBuffer, "PARAGRAPH", "\n", -1)
+	return strings.Join(cleanLineList(strings.Split(storyBuffer, "\n")), "\n")
+}
+
+// tocStage drops the table of contents and writes the chapter headers.
+func tocStage(input string, state *cleanState) string {
+	story := RemoveToCAndResolveChapterSeperators(strings.Split(input, "\n"), 20, 15, state.audit)
+	return strings.Replace(story, "HEADER!", "", -1)
+}
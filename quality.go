@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// qualityReport holds the document quality scores of a cleaned book
+type qualityReport struct {
+	CharCount           int     `json:"charCount"`
+	AlphaRatio          float64 `json:"alphaRatio"`
+	MeanWordLength      float64 `json:"meanWordLength"`
+	DuplicateLineRatio  float64 `json:"duplicateLineRatio"`
+	SymbolRatio         float64 `json:"symbolRatio"`
+	IndexLineRatio      float64 `json:"indexLineRatio"`
+	MeanParagraphLength float64 `json:"meanParagraphLength"`
+}
+
+// qualityThresholds decide which books are rejected. A zero threshold is not
+// checked.
+type qualityThresholds struct {
+	minChars               int
+	minAlphaRatio          float64
+	minMeanWordLength      float64
+	maxMeanWordLength      float64
+	maxDuplicateLineRatio  float64
+	maxSymbolRatio         float64
+	maxIndexLineRatio      float64
+	minMeanParagraphLength float64
+}
+
+// indexLineRegex matches lines ending in page numbers, as found in indexes
+// and tables of contents ("Rabbit, White, 12, 47-49", "CHAPTER IV. ... 23")
+var indexLineRegex = regexp.MustCompile(`[\s.,:;·…]\s*\d{1,4}(\s*[,–-]\s*\d{1,4})*\.?$`)
+
+// scoreQuality computes the quality scores of cleaned text.
+func scoreQuality(text string) qualityReport {
+	report := qualityReport{CharCount: utf8.RuneCountInString(text)}
+
+	letters, visible, symbols := 0, 0, 0
+	words, wordRunes := 0, 0
+	inWord := false
+	for _, r := range text {
+		switch {
+		case unicode.IsSpace(r):
+			inWord = false
+			continue
+		case isBidiControl(r):
+			//invisible, they only set the direction of the text
+			continue
+		case isIdeograph(r):
+			//scripts written without spaces count every character as a word
+			words++
+			wordRunes++
+			inWord = false
+		case unicode.IsLetter(r) || unicode.IsNumber(r):
+			if !inWord {
+				words++
+			}
+			wordRunes++
+			inWord = true
+		case !unicode.IsPunct(r) && !isCJK(r):
+			//punctuation of any script is prose, curly quotes, guillemets and
+			//dashes included
+			symbols++
+		}
+		visible++
+		if unicode.IsLetter(r) {
+			letters++
+		}
+	}
+	if visible > 0 {
+		report.AlphaRatio = float64(letters) / float64(visible)
+	}
+	if words > 0 {
+		report.MeanWordLength = float64(wordRunes) / float64(words)
+		report.SymbolRatio = float64(symbols) / float64(words)
+	}
+
+	lines, duplicates, indexLines := 0, 0, 0
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		//skip the chapter headers added by RemoveToCAndResolveChapterSeperators
+		if line == "" || line == "***" || (strings.HasPrefix(line, "[ Chapter ") && strings.HasSuffix(line, " ; ]")) {
+			continue
+		}
+		lines++
+		if seen[line] {
+			duplicates++
+		}
+		seen[line] = true
+		if len(line) < 100 && indexLineRegex.MatchString(line) {
+			indexLines++
+		}
+	}
+	if lines > 0 {
+		report.DuplicateLineRatio = float64(duplicates) / float64(lines)
+		report.IndexLineRatio = float64(indexLines) / float64(lines)
+		report.MeanParagraphLength = float64(words) / float64(lines)
+	}
+	return report
+}
+
+// check returns why a book fails the thresholds, or "" when it passes.
+func (t qualityThresholds) check(q qualityReport) string {
+	switch {
+	case t.minChars > 0 && q.CharCount < t.minChars:
+		return fmt.Sprintf("too short (%d characters)", q.CharCount)
+	case t.minAlphaRatio > 0 && q.AlphaRatio < t.minAlphaRatio:
+		return fmt.Sprintf("alphabetic ratio %.3f below %.3f", q.AlphaRatio, t.minAlphaRatio)
+	case t.minMeanWordLength > 0 && q.MeanWordLength < t.minMeanWordLength:
+		return fmt.Sprintf("mean word length %.2f below %.2f", q.MeanWordLength, t.minMeanWordLength)
+	case t.maxMeanWordLength > 0 && q.MeanWordLength > t.maxMeanWordLength:
+		return fmt.Sprintf("mean word length %.2f above %.2f", q.MeanWordLength, t.maxMeanWordLength)
+	case t.maxDuplicateLineRatio > 0 && q.DuplicateLineRatio > t.maxDuplicateLineRatio:
+		return fmt.Sprintf("duplicate line ratio %.3f above %.3f", q.DuplicateLineRatio, t.maxDuplicateLineRatio)
+	case t.maxSymbolRatio > 0 && q.SymbolRatio > t.maxSymbolRatio:
+		return fmt.Sprintf("symbol to word ratio %.3f above %.3f", q.SymbolRatio, t.maxSymbolRatio)
+	case t.maxIndexLineRatio > 0 && q.IndexLineRatio > t.maxIndexLineRatio:
+		return fmt.Sprintf("index line ratio %.3f above %.3f", q.IndexLineRatio, t.maxIndexLineRatio)
+	case t.minMeanParagraphLength > 0 && q.MeanParagraphLength < t.minMeanParagraphLength:
+		return fmt.Sprintf("mean paragraph length %.1f words below %.1f", q.MeanParagraphLength, t.minMeanParagraphLength)
+	}
+	return ""
+}
+
+// buildQualityLine formats the quality scores for the metadata file.
+func buildQualityLine(q *qualityReport) string {
+	return fmt.Sprintf("[ Quality: alphaRatio=%.3f; meanWordLength=%.2f; duplicateLineRatio=%.3f; symbolRatio=%.3f; indexLineRatio=%.3f; meanParagraphLength=%.1f; ]\n",
+		q.AlphaRatio, q.MeanWordLength, q.DuplicateLineRatio, q.SymbolRatio, q.IndexLineRatio, q.MeanParagraphLength)
+}
+
+// isIdeograph reports whether r belongs to a script written without spaces
+// between words.
+func isIdeograph(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana)
+}
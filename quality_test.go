@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestScoreQualityDialogue(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+	}{
+		{"curly quotes", "“Where are you going?” asked Alice.\n‘Down the hole,’ said the Rabbit, ‘and quickly.’"},
+		{"straight quotes", "\"Where are you going?\" asked Alice.\n'Down the hole,' said the Rabbit, 'and quickly.'"},
+		{"guillemets", "« Où allez-vous ? » demanda Alice.\n« Dans le terrier, » dit le Lapin."},
+		{"german quotes", "„Wohin gehst du?“ fragte Alice.\n‚In den Bau‘, sagte das Kaninchen."},
+		{"dashes", "— Where are you going? asked Alice – and the Rabbit ran on…"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			report := scoreQuality(test.text)
+			if report.SymbolRatio != 0 {
+				t.Errorf("symbolRatio = %.3f, want 0", report.SymbolRatio)
+			}
+		})
+	}
+}
+
+func TestScoreQualitySymbols(t *testing.T) {
+	report := scoreQuality("a = b + c | d ~ e")
+	if report.SymbolRatio < 0.5 {
+		t.Errorf("symbolRatio = %.3f, want at least 0.5", report.SymbolRatio)
+	}
+}
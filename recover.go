@@ -0,0 +1,345 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/taylorskalyo/goreader/epub"
+)
+
+// What was recovered of a malformed book, see openBook
+const (
+	recoveredZip       = "zip"
+	recoveredMimetype  = "mimetype"
+	recoveredContainer = "container"
+	recoveredPackage   = "package"
+	recoveredSpine     = "spine"
+	recoveredDocuments = "documents"
+)
+
+// containerPath is where an epub points to its package document
+const containerPath = "META-INF/container.xml"
+
+// maxRecoveredMemberSize is the most a recovered zip member may inflate to,
+// so a small upload can't expand into gigabytes
+const maxRecoveredMemberSize = 100 << 20
+
+// zip signatures of a local file header and of the central directory
+var (
+	localHeaderSignature   = []byte("PK\x03\x04")
+	centralHeaderSignature = []byte("PK\x01\x02")
+)
+
+// openedBook is the archive and package document of a book, with what had
+// to be recovered to open it
+type openedBook struct {
+	z         *zip.Reader
+	book      *epub.Rootfile
+	pkg       *opfPackage
+	recovered []string
+}
+
+// openBook opens the archive and package document of a book. Scraped
+// collections hold books that goreader can't open, so each step falls back
+// to something that still gets the text out: a broken archive is read from
+// its local file headers, a missing container.xml is replaced by the first
+// .opf of the archive, itemrefs matching no manifest item are dropped, and a
+// missing package document or a spine without any readable document is
+// replaced by the (X)HTML files of the archive in filename order. Documents
+// of the spine that are missing are left out when the book is converted, see
+// convertEpub. name is the file name of the book, used as the title when the
+// book has no package document.
+func openBook(r io.ReaderAt, size int64, name string) (*openedBook, error) {
+	opened := &openedBook{}
+	z, err := zip.NewReader(r, size)
+	if err != nil {
+		data, readErr := io.ReadAll(io.NewSectionReader(r, 0, size))
+		if readErr != nil {
+			return nil, readErr
+		}
+		if z, err = recoverZip(data); err != nil {
+			return nil, err
+		}
+		opened.recovered = append(opened.recovered, recoveredZip)
+	}
+	opened.z = z
+	if mimetype, err := readZipFile(z, "mimetype"); err != nil || strings.TrimSpace(string(mimetype)) != "application/epub+zip" {
+		opened.recovered = append(opened.recovered, recoveredMimetype)
+	}
+
+	opfPath := containerRootfile(z)
+	if opfPath == "" {
+		opfPath = findPackage(z)
+		opened.recovered = append(opened.recovered, recoveredContainer)
+	}
+	opened.pkg, opened.book, err = readPackage(z, opfPath)
+	if err != nil {
+		opened.pkg, opened.book = &opfPackage{}, &epub.Rootfile{}
+		opened.book.Title = strings.TrimSuffix(name, ".epub")
+		opened.recovered = append(opened.recovered, recoveredPackage)
+	}
+	//a book without a package document has no spine to recover
+	if dropBrokenItemrefs(opened.pkg) > 0 && err == nil {
+		opened.recovered = append(opened.recovered, recoveredSpine)
+	}
+	if !spineReadable(z, opened.pkg, opened.book.FullPath) {
+		if err == nil && !containsString(opened.recovered, recoveredSpine) {
+			opened.recovered = append(opened.recovered, recoveredSpine)
+		}
+		filenameSpine(z, opened.pkg, opened.book.FullPath)
+	}
+	if len(opened.pkg.Spine.Itemrefs) == 0 {
+		return nil, fmt.Errorf("no text documents found")
+	}
+	return opened, nil
+}
+
+// containerRootfile returns the path of the first package document listed
+// by container.xml that is in the archive, or "".
+func containerRootfile(z *zip.Reader) string {
+	data, err := readZipFile(z, containerPath)
+	if err != nil {
+		return ""
+	}
+	container := epub.Container{}
+	if err := xml.Unmarshal(data, &container); err != nil {
+		return ""
+	}
+	for _, rootfile := range container.Rootfiles {
+		if _, err := z.Open(rootfile.FullPath); err == nil {
+			return rootfile.FullPath
+		}
+	}
+	return ""
+}
+
+// findPackage returns the first .opf file of the archive in filename order,
+// or "".
+func findPackage(z *zip.Reader) string {
+	for _, name := range sortedNames(z) {
+		if strings.EqualFold(path.Ext(name), ".opf") {
+			return name
+		}
+	}
+	return ""
+}
+
+// sortedNames lists the files of the archive in filename order, with numbers
+// sorted by value so chapter2 comes before chapter10.
+func sortedNames(z *zip.Reader) []string {
+	names := make([]string, 0, len(z.File))
+	for _, f := range z.File {
+		if !strings.HasSuffix(f.Name, "/") {
+			names = append(names, f.Name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return naturalLess(names[i], names[j]) })
+	return names
+}
+
+// naturalLess compares two names, comparing runs of digits by their value.
+func naturalLess(a string, b string) bool {
+	for a != "" && b != "" {
+		if isDigit(a[0]) && isDigit(b[0]) {
+			numA, restA := splitDigits(a)
+			numB, restB := splitDigits(b)
+			//without leading zeros the longer number is the larger one
+			trimmedA, trimmedB := strings.TrimLeft(numA, "0"), strings.TrimLeft(numB, "0")
+			if len(trimmedA) != len(trimmedB) {
+				return len(trimmedA) < len(trimmedB)
+			}
+			if trimmedA != trimmedB {
+				return trimmedA < trimmedB
+			}
+			if numA != numB {
+				return numA < numB
+			}
+			a, b = restA, restB
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+// splitDigits splits the leading digits off s.
+func splitDigits(s string) (string, string) {
+	end := 0
+	for end < len(s) && isDigit(s[end]) {
+		end++
+	}
+	return s[:end], s[end:]
+}
+
+// isDigit reports whether c is an ASCII digit.
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// dropBrokenItemrefs removes the itemrefs of the spine that match no manifest
+// item, keeping the order of the others, and returns how many it removed.
+func dropBrokenItemrefs(pkg *opfPackage) int {
+	items := make(map[string]bool)
+	for _, item := range pkg.Items {
+		items[item.ID] = true
+	}
+	kept := pkg.Spine.Itemrefs[:0]
+	for _, itemref := range pkg.Spine.Itemrefs {
+		if items[itemref.IDREF] {
+			kept = append(kept, itemref)
+		}
+	}
+	dropped := len(pkg.Spine.Itemrefs) - len(kept)
+	pkg.Spine.Itemrefs = kept
+	return dropped
+}
+
+// spineReadable reports whether at least one text document of the spine is
+// in the archive. Documents that are missing are left out one by one when the
+// book is converted.
+func spineReadable(z *zip.Reader, pkg *opfPackage, opfPath string) bool {
+	for _, doc := range spineDocs(pkg, opfPath, nonLinearInline) {
+		if _, err := z.Open(doc.path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// filenameSpine replaces the spine with the (X)HTML files of the archive in
+// filename order. They are added to the manifest as well, as the manifest
+// of a broken book can't be trusted either. The navigation document is left
+// out when the manifest names it.
+func filenameSpine(z *zip.Reader, pkg *opfPackage, opfPath string) {
+	nav := make(map[string]bool)
+	for _, item := range pkg.Items {
+		if hasWord(item.Properties, "nav") {
+			itemPath, _ := resolveHREF(opfPath, item.HREF)
+			nav[itemPath] = true
+		}
+	}
+	pkg.Spine.Itemrefs = pkg.Spine.Itemrefs[:0]
+	for i, name := range sortedNames(z) {
+		switch strings.ToLower(path.Ext(name)) {
+		case ".xhtml", ".html", ".htm":
+		default:
+			continue
+		}
+		if nav[name] {
+			continue
+		}
+		//hrefs are relative to the package document
+		href := name
+		if dir := path.Dir(opfPath); strings.HasPrefix(name, dir+"/") {
+			href = strings.TrimPrefix(name, dir+"/")
+		} else if dir != "." {
+			href = strings.Repeat("../", strings.Count(dir, "/")+1) + name
+		}
+		id := fmt.Sprintf("recovered-%d", i)
+		pkg.Items = append(pkg.Items, opfItem{ID: id, HREF: href, MediaType: "application/xhtml+xml"})
+		pkg.Spine.Itemrefs = append(pkg.Spine.Itemrefs, opfItemref{IDREF: id})
+	}
+}
+
+// recoverZip reads the members of an archive whose central directory is
+// broken from their local file headers, and returns them as a new archive.
+// Members that can't be read are left out.
+func recoverZip(data []byte) (*zip.Reader, error) {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	seen := make(map[string]bool)
+	for pos := 0; ; {
+		start := bytes.Index(data[pos:], localHeaderSignature)
+		if start < 0 {
+			break
+		}
+		pos += start
+		name, content, next, err := readLocalMember(data, pos)
+		if err != nil || seen[name] {
+			pos += len(localHeaderSignature)
+			continue
+		}
+		seen[name] = true
+		f, err := w.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write(content); err != nil {
+			return nil, err
+		}
+		pos = next
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if len(seen) == 0 {
+		return nil, errors.New("no readable zip members found")
+	}
+	return zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+}
+
+// readLocalMember reads the member whose local file header starts at pos. It
+// returns its name, its uncompressed content and where the member ends. A
+// member that inflates to more than its declared size, or more than
+// maxRecoveredMemberSize, is an error.
+func readLocalMember(data []byte, pos int) (string, []byte, int, error) {
+	if len(data) < pos+30 {
+		return "", nil, 0, io.ErrUnexpectedEOF
+	}
+	header := data[pos : pos+30]
+	flags := binary.LittleEndian.Uint16(header[6:])
+	method := binary.LittleEndian.Uint16(header[8:])
+	compressedSize := int(binary.LittleEndian.Uint32(header[18:]))
+	uncompressedSize := int64(binary.LittleEndian.Uint32(header[22:]))
+	nameLength := int(binary.LittleEndian.Uint16(header[26:]))
+	extraLength := int(binary.LittleEndian.Uint16(header[28:]))
+	start := pos + 30 + nameLength + extraLength
+	if start > len(data) || nameLength == 0 {
+		return "", nil, 0, io.ErrUnexpectedEOF
+	}
+	name := string(data[pos+30 : pos+30+nameLength])
+
+	//with a data descriptor the sizes follow the data, so the member ends at
+	//the next header
+	end := start + compressedSize
+	if flags&0x8 != 0 && compressedSize == 0 {
+		end = len(data)
+		for _, signature := range [][]byte{localHeaderSignature, centralHeaderSignature} {
+			if i := bytes.Index(data[start:], signature); i >= 0 && start+i < end {
+				end = start + i
+			}
+		}
+	}
+	if end > len(data) {
+		return "", nil, 0, io.ErrUnexpectedEOF
+	}
+
+	switch method {
+	case zip.Store:
+		return name, data[start:end], end, nil
+	case zip.Deflate:
+		//inflate no more than the header declares, when it declares a size
+		limit := int64(maxRecoveredMemberSize)
+		if flags&0x8 == 0 && uncompressedSize < limit {
+			limit = uncompressedSize
+		}
+		content, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(data[start:end])), limit+1))
+		if err == nil && int64(len(content)) > limit {
+			err = fmt.Errorf("%s inflates to more than %d bytes", name, limit)
+		}
+		return name, content, end, err
+	}
+	return "", nil, 0, fmt.Errorf("unsupported compression method %d", method)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"testing"
+)
+
+// localMember builds a deflated zip member with a local file header that
+// declares the given uncompressed size.
+func localMember(t *testing.T, name string, content []byte, declared uint32) []byte {
+	t.Helper()
+	var compressed bytes.Buffer
+	fw, err := flate.NewWriter(&compressed, flate.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(content)
+	fw.Close()
+
+	header := make([]byte, 30)
+	copy(header, localHeaderSignature)
+	binary.LittleEndian.PutUint16(header[8:], 8)
+	binary.LittleEndian.PutUint32(header[18:], uint32(compressed.Len()))
+	binary.LittleEndian.PutUint32(header[22:], declared)
+	binary.LittleEndian.PutUint16(header[26:], uint16(len(name)))
+	return append(append(header, name...), compressed.Bytes()...)
+}
+
+func TestReadLocalMemberLimit(t *testing.T) {
+	content := bytes.Repeat([]byte("all work and no play "), 1000)
+	tests := []struct {
+		name     string
+		declared uint32
+		ok       bool
+	}{
+		{"declared size", uint32(len(content)), true},
+		{"larger than declared", 100, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := localMember(t, "text/chapter.xhtml", content, test.declared)
+			name, got, end, err := readLocalMember(data, 0)
+			if !test.ok {
+				if err == nil {
+					t.Errorf("readLocalMember inflated %d bytes, want an error", len(got))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name != "text/chapter.xhtml" || !bytes.Equal(got, content) || end != len(data) {
+				t.Errorf("readLocalMember = %q, %d bytes, end %d", name, len(got), end)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// wordRegex matches words for the vocabulary, keeping apostrophes and
+// hyphenated compounds together ("don't", "rose-tree")
+var wordRegex = regexp.MustCompile(`\p{L}+(?:['-]\p{L}+)*`)
+
+// hyphenBreakRegex matches a word broken with a hyphen at the end of a line
+var hyphenBreakRegex = regexp.MustCompile(`(\p{L}+)-\n[ \t]*(\p{Ll}\p{L}*)`)
+
+// chapterStartRegex finds where chapters start, before and after the toc
+// stage
+var chapterStartRegex = regexp.MustCompile(`CHAPTER_SEPERATOR|(?m)^\[ Chapter -?\d+: .* ; \]$`)
+
+// blockBreakRegex separates the blocks of a chapter: paragraphs, headers and
+// lines
+var blockBreakRegex = regexp.MustCompile(`PARAGRAPH|HEADER!|\n`)
+
+// markReplacer blanks out the parser marks, which are glued to the words
+// around them
+var markReplacer = strings.NewReplacer("PARAGRAPH", " ", "HEADER!", " ", "CHAPTER_SEPERATOR", " ", "MARKED_FOR_DELETION", " ")
+
+// dropCapMinWords is the least number of words of the first body paragraph of
+// a chapter. Shorter blocks are taken as chapter titles.
+const dropCapMinWords = 8
+
+// dictionaries caches the word lists given with -dictionary
+var dictionaries = newFileCache(func(path string, data []byte) (map[string]bool, error) {
+	words := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if word := strings.TrimSpace(scanner.Text()); word != "" {
+			words[strings.ToLower(word)] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return words, nil
+})
+
+// loadDictionary loads a word list with one word per line.
+func loadDictionary(path string) (map[string]bool, error) {
+	return dictionaries.get(path)
+}
+
+// vocabulary counts the words of the book in lower case. It is built on
+// first use from the text the stage received and shared by the repair stages.
+func (state *cleanState) vocabulary(input string) map[string]int {
+	if state.words == nil {
+		state.words = make(map[string]int)
+		input = markReplacer.Replace(input)
+		for _, word := range wordRegex.FindAllString(input, -1) {
+			state.words[strings.ToLower(word)]++
+		}
+	}
+	return state.words
+}
+
+// knownWord returns how often word occurs in the book, or 1 for a word that
+// is only found in the -dictionary word list.
+func (state *cleanState) knownWord(input string, word string) int {
+	word = strings.ToLower(word)
+	if n := state.vocabulary(input)[word]; n > 0 {
+		return n
+	}
+	if state.config.dictionary[word] {
+		return 1
+	}
+	return 0
+}
+
+// dehyphenateStage joins words hyphenated across line breaks. A word is
+// joined without the hyphen when the joined form is found in the book or the
+// dictionary at least as often as the hyphenated one. Otherwise only the line
+// break is removed, so compounds like "rose-tree" keep their hyphen.
+func dehyphenateStage(input string, state *cleanState) string {
+	var sb strings.Builder
+	last, line := 0, 0
+	for _, loc := range hyphenBreakRegex.FindAllStringSubmatchIndex(input, -1) {
+		//marks are glued to the word that follows them
+		for _, mark := range []string{"PARAGRAPH", "SEPERATOR"} {
+			if strings.HasPrefix(input[loc[2]:loc[3]], mark) && loc[3]-loc[2] > len(mark) {
+				loc[0] += len(mark)
+				loc[2] += len(mark)
+			}
+		}
+		left, right := input[loc[2]:loc[3]], input[loc[4]:loc[5]]
+		joined, rule := left+right, "joined"
+		known := state.knownWord(input, joined)
+		if known == 0 || known < state.vocabulary(input)[strings.ToLower(left+"-"+right)] {
+			joined, rule = left+"-"+right, "compound"
+		}
+		if state.audit != nil {
+			line += strings.Count(input[last:loc[0]], "\n")
+			state.audit.add(rule, line, loc[0], input[loc[0]:loc[1]])
+			line += strings.Count(input[loc[0]:loc[1]], "\n")
+		}
+		sb.WriteString(input[last:loc[0]])
+		sb.WriteString(joined)
+		last = loc[1]
+		state.repairs++
+	}
+	sb.WriteString(input[last:])
+	return sb.String()
+}
+
+// dropCapsStage repairs the first word of a chapter when its initial was set
+// as a drop cap and ended up split from the word ("A LICE was"). The letter
+// is joined when that makes a word more frequent in the book.
+func dropCapsStage(input string, state *cleanState) string {
+	starts := []int{0}
+	for _, loc := range chapterStartRegex.FindAllStringIndex(input, -1) {
+		starts = append(starts, loc[1])
+	}
+
+	var sb strings.Builder
+	last := 0
+	for i, start := range starts {
+		end := len(input)
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		pos, repaired, ok := repairDropCap(input, start, end, state)
+		if !ok || pos < last {
+			continue
+		}
+		if state.audit != nil {
+			state.audit.add("drop cap", strings.Count(input[:pos], "\n"), pos, input[pos:pos+len(repaired.from)])
+		}
+		sb.WriteString(input[last:pos])
+		sb.WriteString(repaired.to)
+		last = pos + len(repaired.from)
+		state.repairs++
+	}
+	sb.WriteString(input[last:])
+	return sb.String()
+}
+
+// dropCapFix replaces from with to
+type dropCapFix struct {
+	from string
+	to   string
+}
+
+// repairDropCap looks at the first body paragraph of the chapter in
+// input[start:end] and returns where its first word starts and how to repair
+// it.
+func repairDropCap(input string, start int, end int, state *cleanState) (int, dropCapFix, bool) {
+	chapter := input[start:end]
+	blockStart := 0
+	previous, previousPos := "", 0
+	for _, loc := range append(blockBreakRegex.FindAllStringIndex(chapter, -1), []int{len(chapter), len(chapter)}) {
+		block := chapter[blockStart:loc[0]]
+		blockOffset := blockStart
+		blockStart = loc[1]
+		trimmed := strings.TrimSpace(block)
+		if trimmed == "" {
+			continue
+		}
+		words := strings.Fields(trimmed)
+		if len(words) < dropCapMinWords {
+			previous, previousPos = trimmed, start+blockOffset+strings.Index(block, trimmed)
+			continue
+		}
+
+		first := strings.TrimRightFunc(words[0], func(r rune) bool { return !unicode.IsLetter(r) })
+		if !isUpperWord(first) {
+			return 0, dropCapFix{}, false
+		}
+		pos := start + blockOffset + strings.Index(block, first)
+
+		//the initial was split from the word, in the same block or the one before
+		if utf8.RuneCountInString(first) == 1 && len(words) > 1 && isUpperWord(words[1]) {
+			word := strings.TrimRightFunc(words[1], func(r rune) bool { return !unicode.IsLetter(r) })
+			if state.knownWord(input, first+word) > state.knownWord(input, word) {
+				from := input[pos : pos+strings.Index(input[pos:], word)+len(word)]
+				return pos, dropCapFix{from: from, to: first + word}, true
+			}
+		}
+		if utf8.RuneCountInString(previous) == 1 && isUpperWord(previous) && state.knownWord(input, previous+first) > state.knownWord(input, first) {
+			return previousPos, dropCapFix{from: input[previousPos : pos+len(first)], to: previous + first}, true
+		}
+
+		//a lost initial can't be told apart from a word that starts a chapter
+		//in capitals ("HE was"), so it is left alone
+		return 0, dropCapFix{}, false
+	}
+	return 0, dropCapFix{}, false
+}
+
+// isUpperWord reports whether word is made of upper case letters only.
+func isUpperWord(word string) bool {
+	if word == "" {
+		return false
+	}
+	for _, r := range word {
+		if !unicode.IsUpper(r) {
+			return false
+		}
+	}
+	return true
+}
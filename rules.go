@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// defaultRulesJSON is the rule set used by -gutenbergCleaning unless -rules
+// names another file. It doubles as an example rules file.
+//
+//go:embed rules/gutenberg.json
+var defaultRulesJSON []byte
+
+// Actions of a cleaning rule
+const (
+	ruleCutBefore = "cutBefore"
+	ruleCutAfter  = "cutAfter"
+	ruleDropLine  = "dropLine"
+	ruleDropMatch = "dropMatch"
+)
+
+// cleaningRule is one entry of a rules file. A rule matches a line when any
+// of its patterns is found in the line and the line is inside the window
+// given by the line and percent bounds. A zero bound is not checked.
+type cleaningRule struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Patterns    []string `json:"patterns"`
+	Regex       bool     `json:"regex,omitempty"`
+	IgnoreCase  bool     `json:"ignoreCase,omitempty"`
+	MinLine     int      `json:"minLine,omitempty"`
+	MaxLine     int      `json:"maxLine,omitempty"`
+	MinPercent  float64  `json:"minPercent,omitempty"`
+	MaxPercent  float64  `json:"maxPercent,omitempty"`
+	Action      string   `json:"action"`
+	Offset      int      `json:"offset,omitempty"`
+
+	matchers []*regexp.Regexp
+}
+
+// ruleSet is a parsed rules file
+type ruleSet struct {
+	name  string
+	Rules []cleaningRule `json:"rules"`
+}
+
+// ruleSets caches the rules files given with -rules
+var ruleSets = newFileCache(func(path string, data []byte) (*ruleSet, error) {
+	rules, err := parseRuleSet(data)
+	if err != nil {
+		return nil, fmt.Errorf("loading rules %s: %w", path, err)
+	}
+	rules.name = path
+	return rules, nil
+})
+
+var (
+	defaultRulesOnce sync.Once
+	defaultRules     *ruleSet
+	defaultRulesErr  error
+)
+
+// loadRuleSet loads a rules file, or the default rule set when path is
+// empty.
+func loadRuleSet(path string) (*ruleSet, error) {
+	if path != "" {
+		return ruleSets.get(path)
+	}
+	defaultRulesOnce.Do(func() {
+		defaultRules, defaultRulesErr = parseRuleSet(defaultRulesJSON)
+		if defaultRulesErr != nil {
+			defaultRulesErr = fmt.Errorf("loading rules default: %w", defaultRulesErr)
+		} else {
+			defaultRules.name = "default"
+		}
+	})
+	return defaultRules, defaultRulesErr
+}
+
+// parseRuleSet reads and validates a rules file.
+func parseRuleSet(data []byte) (*ruleSet, error) {
+	rules := &ruleSet{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(rules); err != nil {
+		return nil, err
+	}
+	if len(rules.Rules) == 0 {
+		return nil, errors.New("no rules found")
+	}
+	for i := range rules.Rules {
+		rule := &rules.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		if len(rule.Patterns) == 0 {
+			return nil, fmt.Errorf("%s: no patterns", rule.Name)
+		}
+		switch rule.Action {
+		case ruleCutBefore, ruleCutAfter, ruleDropLine, ruleDropMatch:
+		default:
+			return nil, fmt.Errorf("%s: action must be one of the following: cutBefore, cutAfter, dropLine, dropMatch", rule.Name)
+		}
+		if rule.MinPercent < 0 || rule.MinPercent > 100 || rule.MaxPercent < 0 || rule.MaxPercent > 100 {
+			return nil, fmt.Errorf("%s: percent bounds must be between 0 and 100", rule.Name)
+		}
+
+		//plain case sensitive patterns are matched with strings.Contains
+		if !rule.Regex && !rule.IgnoreCase && rule.Action != ruleDropMatch {
+			continue
+		}
+		for _, pattern := range rule.Patterns {
+			if !rule.Regex {
+				pattern = regexp.QuoteMeta(pattern)
+			}
+			if rule.IgnoreCase {
+				pattern = "(?i)" + pattern
+			}
+			matcher, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", rule.Name, err)
+			}
+			rule.matchers = append(rule.matchers, matcher)
+		}
+	}
+	return rules, nil
+}
+
+// matches reports whether any pattern of the rule is found in line.
+func (rule *cleaningRule) matches(line string) bool {
+	for i, pattern := range rule.Patterns {
+		if rule.matchers != nil {
+			if rule.matchers[i].MatchString(line) {
+				return true
+			}
+		} else if strings.Contains(line, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// inWindow reports whether line index of a book of lineCount lines is inside
+// the window of the rule.
+func (rule *cleaningRule) inWindow(index int, lineCount int) bool {
+	linePercent := float64(index) / float64(lineCount)
+	switch {
+	case index < rule.MinLine:
+		return false
+	case rule.MaxLine > 0 && index >= rule.MaxLine:
+		return false
+	case rule.MinPercent > 0 && linePercent <= rule.MinPercent/100:
+		return false
+	case rule.MaxPercent > 0 && linePercent >= rule.MaxPercent/100:
+		return false
+	}
+	return true
+}
+
+// dropMatches removes the text matched by the rule from line and returns the
+// line with the removed pieces and their offsets.
+func (rule *cleaningRule) dropMatches(line string) (string, []string, []int) {
+	var removed []string
+	var offsets []int
+	for _, matcher := range rule.matchers {
+		for _, loc := range matcher.FindAllStringIndex(line, -1) {
+			removed = append(removed, line[loc[0]:loc[1]])
+			offsets = append(offsets, loc[0])
+		}
+		line = matcher.ReplaceAllString(line, "")
+	}
+	return line, removed, offsets
+}
+
+// applyCleaningRules runs the rules in order over the lines of a book. Cut
+// rules act on the first matching line only, dropLine and dropMatch on every
+// matching line. Removed lines are marked for deletion, see resolveAllMarks.
+// dropMatch removes only the matched text, and the line when nothing else is
+// left.
+func applyCleaningRules(lines []string, rules *ruleSet, audit *cleanAudit) []string {
+	lineCount := len(lines)
+	var offsets []int
+	if audit != nil {
+		offsets = lineOffsets(lines)
+	}
+	for r := range rules.Rules {
+		rule := &rules.Rules[r]
+		var before []string
+		if audit != nil {
+			before = append([]string{}, lines...)
+		}
+		for i, line := range lines {
+			if !rule.inWindow(i, lineCount) || !rule.matches(line) {
+				continue
+			}
+			if rule.Action == ruleDropLine {
+				lines = markLineForDeletion(lines, i)
+				continue
+			}
+			if rule.Action == ruleDropMatch {
+				dropped, removed, at := rule.dropMatches(line)
+				if strings.TrimSpace(dropped) == "" {
+					lines = markLineForDeletion(lines, i)
+					continue
+				}
+				if audit != nil {
+					for j := range removed {
+						audit.add(rule.Name, i, offsets[i]+at[j], removed[j])
+					}
+				}
+				lines[i] = dropped
+				continue
+			}
+			cut := i + rule.Offset
+			if cut < 0 {
+				cut = 0
+			}
+			if cut > len(lines) {
+				cut = len(lines)
+			}
+			if rule.Action == ruleCutBefore {
+				lines = markLinesBeforeForDeletion(lines, cut)
+			} else {
+				lines = markLinesAfterForDeletion(lines, cut)
+			}
+			break
+		}
+		if audit != nil {
+			audit.addMarkedLines(rule.Name, before, lines, offsets)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDefaultBibliographyRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		heading string
+		at      int
+		cut     bool
+	}{
+		{"Bibliography near the start", "Bibliography", 20, true},
+		{"Bibliography anywhere", "Bibliography", 150, true},
+		{"BIBLIOGRAPHY. near the start", "BIBLIOGRAPHY.", 20, true},
+		{"BIBLIOGRAPHY. later on", "BIBLIOGRAPHY.", 150, false},
+	}
+	rules, err := loadRuleSet("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lines := make([]string, 200)
+			for i := range lines {
+				lines[i] = fmt.Sprintf("line %d", i)
+			}
+			lines[test.at] = test.heading
+			lines = applyCleaningRules(lines, rules, nil)
+			if cut := lines[test.at] == "MARKED_FOR_DELETION"; cut != test.cut {
+				t.Errorf("line %d cut = %v, want %v", test.at, cut, test.cut)
+			}
+			if lines[test.at+1] == "MARKED_FOR_DELETION" {
+				t.Errorf("line %d after the heading was cut", test.at+1)
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// sentenceRecord is one sentence of a book with its position
+type sentenceRecord struct {
+	Book      string `json:"book"`
+	Chapter   int    `json:"chapter"`
+	Paragraph int    `json:"paragraph"`
+	Sentence  int    `json:"sentence"`
+	Text      string `json:"text"`
+}
+
+// abbreviations are words that are followed by a full stop without ending
+// the sentence, compared in lower case without the stop
+var abbreviations = map[string]bool{
+	"mr": true, "mrs": true, "ms": true, "messrs": true, "mme": true, "mlle": true,
+	"dr": true, "st": true, "mt": true, "jr": true, "sr": true, "esq": true,
+	"prof": true, "rev": true, "revd": true, "capt": true, "lt": true, "sgt": true,
+	"maj": true, "adm": true, "gov": true, "bros": true, "ltd": true, "inc": true,
+	"vs": true, "etc": true, "viz": true, "cf": true, "ibid": true, "i.e": true,
+	"e.g": true, "a.m": true, "p.m": true, "ca": true, "approx": true, "feb": true,
+	"apr": true, "jun": true, "jul": true, "sep": true, "oct": true, "nov": true,
+}
+
+// numberAbbreviations are only abbreviations before a number ("No. 5",
+// "p. 12", "Chap. IV"), otherwise they are words that often end a sentence ("she said
+// no.")
+var numberAbbreviations = map[string]bool{
+	"no": true, "nos": true, "p": true, "pp": true, "vol": true, "vols": true,
+	"ch": true, "chap": true, "fig": true,
+}
+
+// capitalAbbreviations are only abbreviations when capitalised ("Gen. Lee",
+// "Dec. 25"), in lower case they are words or names
+var capitalAbbreviations = map[string]bool{
+	"gen": true, "col": true, "hon": true, "sen": true, "rep": true, "fr": true,
+	"co": true, "ed": true, "eds": true, "trans": true, "jan": true, "mar": true,
+	"aug": true, "sept": true, "dec": true,
+}
+
+// closingPunctuation may follow the end of a sentence and belongs to it
+const closingPunctuation = "\"'”’»)]"
+
+// openingPunctuation may start a sentence
+const openingPunctuation = "\"'“‘«(["
+
+// segmentSentences splits a paragraph into sentences. A sentence ends at
+// '.', '!', '?' or an ellipsis, together with any closing quotes, when the
+// next word starts with a capital letter or a digit. Abbreviations, initials
+// and regnal numbers ("Henry VIII.") don't end a sentence.
+func segmentSentences(paragraph string) []string {
+	sentences := []string{}
+	start := 0
+	for i := 0; i < len(paragraph); {
+		r, size := utf8.DecodeRuneInString(paragraph[i:])
+		if !isTerminal(r) {
+			i += size
+			continue
+		}
+
+		//take the whole run of terminal punctuation and closing quotes
+		end := i + size
+		for end < len(paragraph) {
+			next, nextSize := utf8.DecodeRuneInString(paragraph[end:])
+			if !isTerminal(next) && !strings.ContainsRune(closingPunctuation, next) {
+				break
+			}
+			end += nextSize
+		}
+
+		if isSentenceEnd(paragraph, i, end) {
+			if sentence := strings.TrimSpace(paragraph[start:end]); sentence != "" {
+				sentences = append(sentences, sentence)
+			}
+			start = end
+		}
+		i = end
+	}
+	if rest := strings.TrimSpace(paragraph[start:]); rest != "" {
+		sentences = append(sentences, rest)
+	}
+	return sentences
+}
+
+// isTerminal reports whether r can end a sentence.
+func isTerminal(r rune) bool {
+	return strings.ContainsRune(".!?…。！？", r)
+}
+
+// isSentenceEnd decides whether the punctuation at paragraph[stop:end] ends
+// a sentence.
+func isSentenceEnd(paragraph string, stop int, end int) bool {
+	//full width punctuation always ends a sentence, no space follows it
+	if r, _ := utf8.DecodeRuneInString(paragraph[stop:]); strings.ContainsRune("。！？", r) {
+		return true
+	}
+
+	//the next word has to be separated by whitespace
+	rest := paragraph[end:]
+	trimmed := strings.TrimLeftFunc(rest, unicode.IsSpace)
+	if trimmed == "" {
+		return true
+	}
+	if len(trimmed) == len(rest) {
+		return false
+	}
+
+	//and start with a capital letter or a digit, possibly after an opening quote
+	next := strings.TrimLeft(trimmed, openingPunctuation)
+	first, _ := utf8.DecodeRuneInString(next)
+	if !unicode.IsUpper(first) && !unicode.IsDigit(first) && !isIdeograph(first) {
+		return false
+	}
+
+	//only full stops can belong to an abbreviation
+	if paragraph[stop] != '.' || strings.HasPrefix(paragraph[stop:end], "...") {
+		return true
+	}
+	word := lastWord(paragraph[:stop])
+	if word == "" {
+		return true
+	}
+	switch lower := strings.ToLower(word); {
+	case abbreviations[lower]:
+		return false
+	case numberAbbreviations[lower] && (unicode.IsDigit(first) || isRomanNumeral(leadingWord(next)) && leadingWord(next) != "I"):
+		return false
+	case capitalAbbreviations[lower] && unicode.IsUpper([]rune(word)[0]):
+		return false
+	}
+	//initials, as in "J. M. Barrie"
+	if utf8.RuneCountInString(word) == 1 && unicode.IsUpper([]rune(word)[0]) && word != "I" {
+		return false
+	}
+	//regnal numbers after a name, as in "Henry VIII. was crowned"
+	if isRomanNumeral(word) && word != "I" {
+		before := lastWord(strings.TrimSuffix(paragraph[:stop], word))
+		if r, _ := utf8.DecodeRuneInString(before); unicode.IsUpper(r) && !isRomanNumeral(before) {
+			return false
+		}
+	}
+	return true
+}
+
+// lastWord returns the word at the end of text, keeping inner full stops so
+// "e.g" and "i.e" are found as one word.
+func lastWord(text string) string {
+	text = strings.TrimRightFunc(text, unicode.IsSpace)
+	start := strings.LastIndexFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && r != '.'
+	})
+	return strings.Trim(text[start+1:], ".")
+}
+
+// leadingWord returns the letters at the start of text.
+func leadingWord(text string) string {
+	if end := strings.IndexFunc(text, func(r rune) bool { return !unicode.IsLetter(r) }); end >= 0 {
+		return text[:end]
+	}
+	return text
+}
+
+// isRomanNumeral reports whether word is an upper case roman numeral.
+func isRomanNumeral(word string) bool {
+	if word == "" {
+		return false
+	}
+	for _, r := range word {
+		if !strings.ContainsRune("IVXLCDM", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// bookSentences segments a converted book, keyed by chapter and paragraph.
+// Chapters are numbered as in their chapter header.
+func bookSentences(result *bookResult) []sentenceRecord {
+	sentences := []sentenceRecord{}
+	for _, chapter := range splitChapters(result.text) {
+		paragraphIndex := 0
+		for _, paragraph := range strings.Split(chapter.Text, "\n") {
+			paragraph = strings.TrimSpace(paragraph)
+			if paragraph == "" {
+				continue
+			}
+			for n, sentence := range segmentSentences(paragraph) {
+				sentences = append(sentences, sentenceRecord{
+					Book:      result.meta.filename,
+					Chapter:   chapter.Index,
+					Paragraph: paragraphIndex,
+					Sentence:  n,
+					Text:      sentence,
+				})
+			}
+			paragraphIndex++
+		}
+	}
+	return sentences
+}
+
+// renderSentences writes one sentence per line, or one json record per line
+// for the sentencesjson format.
+func renderSentences(result *bookResult, config programConfig) []byte {
+	out := []byte{}
+	for _, sentence := range bookSentences(result) {
+		if config.outputFormat == "sentences" {
+			out = append(append(out, sentence.Text...), '\n')
+			continue
+		}
+		out = appendJSONLine(out, sentence)
+	}
+	return out
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSegmentSentences(t *testing.T) {
+	tests := []struct {
+		name      string
+		paragraph string
+		want      []string
+	}{
+		{"plain", "It was late. The house was dark.",
+			[]string{"It was late.", "The house was dark."}},
+		{"title", "Mr. Darcy bowed. Mrs. Bennet did not.",
+			[]string{"Mr. Darcy bowed.", "Mrs. Bennet did not."}},
+		{"saint", "They walked to St. Paul's together. It rained.",
+			[]string{"They walked to St. Paul's together.", "It rained."}},
+		{"no as a word", "She said no. Then she left.",
+			[]string{"She said no.", "Then she left."}},
+		{"no before a number", "He lived at No. 5 Baker Street. It was small.",
+			[]string{"He lived at No. 5 Baker Street.", "It was small."}},
+		{"page", "See p. 12 for the map. It is old.",
+			[]string{"See p. 12 for the map.", "It is old."}},
+		{"chapter numeral", "As told in Chap. IV the war ended.",
+			[]string{"As told in Chap. IV the war ended."}},
+		{"capitalised title", "Gen. Grant arrived. The men cheered.",
+			[]string{"Gen. Grant arrived.", "The men cheered."}},
+		{"lower case word", "The ship sailed from the co. Then it sank.",
+			[]string{"The ship sailed from the co.", "Then it sank."}},
+		{"month", "It was Dec. 25 and cold. Snow fell.",
+			[]string{"It was Dec. 25 and cold.", "Snow fell."}},
+		{"initials", "J. M. Barrie wrote it. It was a success.",
+			[]string{"J. M. Barrie wrote it.", "It was a success."}},
+		{"dialogue", "\"Where are you going?\" she asked. \"Home,\" he said.",
+			[]string{"\"Where are you going?\" she asked.", "\"Home,\" he said."}},
+		{"closing quote", "“I won’t go.” He turned away.",
+			[]string{"“I won’t go.”", "He turned away."}},
+		{"question in quote", "He asked, ‘Is it true?’ Nobody answered.",
+			[]string{"He asked, ‘Is it true?’", "Nobody answered."}},
+		{"ellipsis", "I wonder... Perhaps not.",
+			[]string{"I wonder...", "Perhaps not."}},
+		{"ellipsis character", "I wonder… perhaps not. Yes.",
+			[]string{"I wonder… perhaps not.", "Yes."}},
+		{"regnal number", "In the reign of Henry VIII. England broke with Rome. It was 1534.",
+			[]string{"In the reign of Henry VIII. England broke with Rome.", "It was 1534."}},
+		{"volume numeral", "It is in Vol. II of the set. The rest is lost.",
+			[]string{"It is in Vol. II of the set.", "The rest is lost."}},
+		{"numeral pronoun", "He had read the chap. I think it was good.",
+			[]string{"He had read the chap.", "I think it was good."}},
+		{"pronoun I", "So did I. The end.",
+			[]string{"So did I.", "The end."}},
+		{"chinese", "我来了。他走了。",
+			[]string{"我来了。", "他走了。"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := segmentSentences(test.paragraph); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("segmentSentences(%q) = %q, want %q", test.paragraph, got, test.want)
+			}
+		})
+	}
+}
+
+func TestBookSentencesChapters(t *testing.T) {
+	result := &bookResult{
+		meta: &metadata{filename: "book.epub"},
+		text: "A preamble.\n***\n[ Chapter 3: The Third ; ]\nIt began. It ended.\n",
+	}
+	want := []sentenceRecord{
+		{Book: "book.epub", Chapter: 0, Paragraph: 0, Sentence: 0, Text: "A preamble."},
+		{Book: "book.epub", Chapter: 3, Paragraph: 0, Sentence: 0, Text: "It began."},
+		{Book: "book.epub", Chapter: 3, Paragraph: 0, Sentence: 1, Text: "It ended."},
+	}
+	if got := bookSentences(result); !reflect.DeepEqual(got, want) {
+		t.Errorf("bookSentences = %+v, want %+v", got, want)
+	}
+}
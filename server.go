@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"runtime"
+	"time"
+)
+
+// conversionServer converts epubs posted over http
+type conversionServer struct {
+	defaults    *flag.FlagSet
+	maxBodySize int64
+	timeout     time.Duration
+	slots       chan struct{}
+}
+
+// runServeCommand handles `serve`. The conversion flags given on the command
+// line become the defaults for every request, and each request can override
+// them with query parameters of the same name.
+func runServeCommand(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addrPtr := fs.String("addr", ":8080",
+		"Address the http server listens on. Defaults to ':8080'")
+	maxBodySizePtr := fs.Int64("maxBodySize", 100<<20,
+		"Largest epub accepted in bytes. Defaults to 100MB")
+	timeoutPtr := fs.Duration("timeout", time.Minute,
+		"Time allowed for converting a single book. Defaults to 1m")
+	maxConcurrentPtr := fs.Int("maxConcurrent", runtime.NumCPU(),
+		"Number of books converted at the same time. Defaults to the number of CPUs")
+	flags := registerConfigFlags(fs)
+	fs.Parse(args)
+
+	logOutput = os.Stderr
+	config, err := flags.config()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(2)
+	}
+	//each request converts one book and only gets the book back, so there is
+	//nothing to compare it with and nowhere to write reports
+	if config.dedup != nil {
+		fmt.Fprintln(os.Stderr, "Error: dedup compares the books of a run and can't be used with serve")
+		os.Exit(2)
+	}
+	if config.audit != "off" {
+		fmt.Fprintln(os.Stderr, "Error: audit writes files next to the output and can't be used with serve")
+		os.Exit(2)
+	}
+	if *maxConcurrentPtr < 1 {
+		*maxConcurrentPtr = 1
+	}
+
+	srv := &conversionServer{
+		defaults:    fs,
+		maxBodySize: *maxBodySizePtr,
+		timeout:     *timeoutPtr,
+		slots:       make(chan struct{}, *maxConcurrentPtr),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/convert", srv.handleConvert)
+	mux.HandleFunc("/healthz", srv.handleHealth)
+
+	httpServer := &http.Server{
+		Addr:              *addrPtr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       *timeoutPtr,
+		WriteTimeout:      2 * *timeoutPtr,
+	}
+	log.Printf("Listening on %s (max body %d bytes, timeout %s, %d concurrent conversions)\n",
+		*addrPtr, srv.maxBodySize, srv.timeout, cap(srv.slots))
+	if !config.silent {
+		printConfig(config)
+	}
+	log.Fatal(httpServer.ListenAndServe())
+}
+
+// queryOptions are the options a request can set with query parameters. They
+// only change how the posted book is converted. Options naming files on the
+// server, like -rules, -dictionary and -tokenizer, and options about the
+// output directory or the whole run can only be given to `serve` itself.
+var queryOptions = map[string]bool{
+	"writeHeader": true, "writeMetadata": true, "cleanOutput": true, "stopEarly": true,
+	"skipCopyRight": true, "gutenbergCleaning": true, "pipeline": true, "typography": true,
+	"keepMatter": true, "nonLinear": true, "css": true, "elementPolicy": true, "ruby": true,
+	"bidi": true, "outputFormat": true, "minChars": true, "minAlphaRatio": true,
+	"minMeanWordLength": true, "maxMeanWordLength": true, "maxDuplicateLineRatio": true,
+	"maxSymbolRatio": true, "maxIndexLineRatio": true, "minParagraphLength": true,
+	"minTokens": true, "maxTokens": true, "eotToken": true, "chunkSize": true,
+	"chunkUnit": true, "chunkOverlap": true,
+}
+
+// requestConfig builds the programConfig of a request from the server defaults
+// and the query parameters.
+func (srv *conversionServer) requestConfig(r *http.Request) (programConfig, error) {
+	fs := flag.NewFlagSet("request", flag.ContinueOnError)
+	flags := registerConfigFlags(fs)
+	//carry over the options the server was started with
+	srv.defaults.Visit(func(f *flag.Flag) {
+		if fs.Lookup(f.Name) != nil {
+			fs.Set(f.Name, f.Value.String())
+		}
+	})
+	for name, values := range r.URL.Query() {
+		if fs.Lookup(name) == nil {
+			return programConfig{}, fmt.Errorf("unknown option %q", name)
+		}
+		if !queryOptions[name] {
+			return programConfig{}, fmt.Errorf("option %q can only be set when starting the server", name)
+		}
+		for _, value := range values {
+			if err := fs.Set(name, value); err != nil {
+				return programConfig{}, fmt.Errorf("invalid value %q for %s: %w", value, name, err)
+			}
+		}
+	}
+	return flags.config()
+}
+
+// handleConvert converts the epub in the request body. The body is either the
+// raw epub or a multipart form with the epub as its first file.
+func (srv *conversionServer) handleConvert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "use POST with the epub as the request body")
+		return
+	}
+	config, err := srv.requestConfig(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	data, err := readEpubBody(http.MaxBytesReader(w, r.Body, srv.maxBodySize), r.Header.Get("Content-Type"))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("epub is larger than %d bytes", srv.maxBodySize))
+			return
+		}
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), srv.timeout)
+	defer cancel()
+
+	//wait for a free conversion slot
+	select {
+	case srv.slots <- struct{}{}:
+	case <-ctx.Done():
+		writeError(w, http.StatusServiceUnavailable, "server is busy, try again later")
+		return
+	}
+
+	type outcome struct {
+		result *bookResult
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		//the slot is held until the conversion really finishes, even if the
+		//request has timed out, so abandoned work still counts against the limit
+		defer func() { <-srv.slots }()
+		defer func() {
+			if rec := recover(); rec != nil {
+				done <- outcome{err: fmt.Errorf("conversion failed: %v", rec)}
+			}
+		}()
+		counters := programCounter{timeStart: time.Now(), bookCount: 1}
+		result, err := convertEpub(bytes.NewReader(data), int64(len(data)), "request.epub", config, &counters)
+		done <- outcome{result, err}
+	}()
+
+	var res outcome
+	select {
+	case res = <-done:
+	case <-ctx.Done():
+		writeError(w, http.StatusGatewayTimeout, fmt.Sprintf("conversion took longer than %s", srv.timeout))
+		return
+	}
+	if res.err != nil {
+		writeError(w, http.StatusUnprocessableEntity, res.err.Error())
+		return
+	}
+	if res.result.skipReason != "" {
+		writeError(w, http.StatusUnprocessableEntity, "book skipped: "+res.result.skipReason)
+		return
+	}
+
+	switch config.outputFormat {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+	case "tokens":
+		w.Header().Set("Content-Type", "application/octet-stream")
+	case "chunks", "sentencesjson":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.Write(renderBook(res.result, config))
+}
+
+// handleHealth reports that the server is up and how busy it is.
+func (srv *conversionServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":        "ok",
+		"active":        len(srv.slots),
+		"maxConcurrent": cap(srv.slots),
+	})
+}
+
+// readEpubBody returns the epub bytes of a request body.
+func readEpubBody(body io.Reader, contentType string) ([]byte, error) {
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	if mediaType != "multipart/form-data" {
+		data, err := io.ReadAll(body)
+		if err == nil && len(data) == 0 {
+			err = errors.New("request body is empty")
+		}
+		return data, err
+	}
+
+	reader := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, errors.New("multipart form has no file")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FileName() != "" {
+			return io.ReadAll(part)
+		}
+	}
+}
+
+// writeError sends an error as a small json document.
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
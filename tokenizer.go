@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Pre-tokenization patterns of the GPT-2 and cl100k tokenizers. Go regexps
+// have no lookahead, so the trailing `\s+(?!\S)` rule of the originals is
+// applied by hand in pretokenize.
+var (
+	gpt2Pattern   = regexp.MustCompile(`^(?:'s|'t|'re|'ve|'m|'ll|'d| ?\p{L}+| ?\p{N}+| ?[^\s\p{L}\p{N}]+|\s+)`)
+	cl100kPattern = regexp.MustCompile(`^(?:(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+)`)
+)
+
+// tokenizerCacheLimit caps the number of pre-tokens whose encoding is cached
+const tokenizerCacheLimit = 1 << 17
+
+// bpeTokenizer is a byte-level BPE tokenizer loaded from a Hugging Face
+// tokenizer.json or a tiktoken rank file. Tokens are kept as raw bytes.
+type bpeTokenizer struct {
+	path       string
+	vocab      map[string]int
+	mergeRanks map[[2]string]int
+	special    map[string]int
+	pattern    *regexp.Regexp
+	vocabSize  int
+
+	mu    sync.Mutex
+	cache map[string][]int
+}
+
+// tokenizers caches the tokenizers given with -tokenizer
+var tokenizers = newFileCache(func(path string, data []byte) (*bpeTokenizer, error) {
+	var t *bpeTokenizer
+	var err error
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		t, err = parseHFTokenizer(data)
+	} else {
+		t, err = parseTiktokenRanks(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loading tokenizer %s: %w", path, err)
+	}
+	t.path = path
+	t.cache = make(map[string][]int)
+	for _, id := range t.vocab {
+		if id >= t.vocabSize {
+			t.vocabSize = id + 1
+		}
+	}
+	for _, id := range t.special {
+		if id >= t.vocabSize {
+			t.vocabSize = id + 1
+		}
+	}
+	return t, nil
+})
+
+// loadTokenizer loads a tokenizer definition.
+func loadTokenizer(path string) (*bpeTokenizer, error) {
+	return tokenizers.get(path)
+}
+
+// hfTokenizerFile is the part of a Hugging Face tokenizer.json we use
+type hfTokenizerFile struct {
+	AddedTokens []struct {
+		ID      int    `json:"id"`
+		Content string `json:"content"`
+	} `json:"added_tokens"`
+	PreTokenizer json.RawMessage `json:"pre_tokenizer"`
+	Decoder      json.RawMessage `json:"decoder"`
+	Model        struct {
+		Type   string          `json:"type"`
+		Vocab  map[string]int  `json:"vocab"`
+		Merges json.RawMessage `json:"merges"`
+	} `json:"model"`
+}
+
+// parseHFTokenizer reads a byte-level BPE tokenizer.json, as used by GPT-2,
+// RoBERTa, Llama 3 and most other byte-level models.
+func parseHFTokenizer(data []byte) (*bpeTokenizer, error) {
+	var file hfTokenizerFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	if file.Model.Type != "BPE" {
+		return nil, fmt.Errorf("model type %q is not supported, only BPE", file.Model.Type)
+	}
+	if !bytes.Contains(file.PreTokenizer, []byte(`"ByteLevel"`)) && !bytes.Contains(file.Decoder, []byte(`"ByteLevel"`)) {
+		return nil, errors.New("only byte-level BPE tokenizers are supported")
+	}
+
+	//tokens are stored with every byte mapped to a printable character
+	decode := make(map[rune]byte)
+	for b, r := range byteLevelAlphabet() {
+		decode[r] = byte(b)
+	}
+	toBytes := func(token string) (string, bool) {
+		out := make([]byte, 0, len(token))
+		for _, r := range token {
+			b, ok := decode[r]
+			if !ok {
+				return "", false
+			}
+			out = append(out, b)
+		}
+		return string(out), true
+	}
+
+	t := &bpeTokenizer{
+		vocab:      make(map[string]int, len(file.Model.Vocab)),
+		mergeRanks: make(map[[2]string]int),
+		special:    make(map[string]int),
+		pattern:    gpt2Pattern,
+	}
+	for token, id := range file.Model.Vocab {
+		if raw, ok := toBytes(token); ok {
+			t.vocab[raw] = id
+		}
+	}
+	for _, added := range file.AddedTokens {
+		t.special[added.Content] = added.ID
+	}
+
+	//merges are either "a b" strings or, in newer files, ["a", "b"] pairs
+	var merges [][2]string
+	var mergeStrings []string
+	if err := json.Unmarshal(file.Model.Merges, &mergeStrings); err == nil {
+		for _, merge := range mergeStrings {
+			left, right, ok := strings.Cut(merge, " ")
+			if !ok {
+				return nil, fmt.Errorf("malformed merge %q", merge)
+			}
+			merges = append(merges, [2]string{left, right})
+		}
+	} else if err := json.Unmarshal(file.Model.Merges, &merges); err != nil {
+		return nil, fmt.Errorf("reading merges: %w", err)
+	}
+	for rank, merge := range merges {
+		left, okLeft := toBytes(merge[0])
+		right, okRight := toBytes(merge[1])
+		if okLeft && okRight {
+			t.mergeRanks[[2]string{left, right}] = rank
+		}
+	}
+	return t, nil
+}
+
+// parseTiktokenRanks reads a tiktoken rank file, one base64 token and its
+// rank per line. The rank of a merged token doubles as its merge priority.
+func parseTiktokenRanks(data []byte) (*bpeTokenizer, error) {
+	t := &bpeTokenizer{
+		vocab:   make(map[string]int),
+		special: make(map[string]int),
+		pattern: cl100kPattern,
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a token and a rank", line)
+		}
+		token, err := base64.StdEncoding.DecodeString(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		rank, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		t.vocab[string(token)] = rank
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(t.vocab) == 0 {
+		return nil, errors.New("no tokens found")
+	}
+	ranks := make(map[int]bool, len(t.vocab))
+	for _, rank := range t.vocab {
+		ranks[rank] = true
+	}
+	for token, id := range tiktokenSpecialTokens[len(t.vocab)] {
+		if !ranks[id] {
+			t.special[token] = id
+		}
+	}
+	return t, nil
+}
+
+// tiktokenSpecialTokens are the special tokens of the OpenAI encodings, by
+// the number of ranks in their rank file. Rank files leave them out.
+var tiktokenSpecialTokens = map[int]map[string]int{
+	//r50k_base (gpt2)
+	50256: {"<|endoftext|>": 50256},
+	//p50k_base
+	50280: {"<|endoftext|>": 50256},
+	//cl100k_base
+	100256: {"<|endoftext|>": 100257, "<|fim_prefix|>": 100258, "<|fim_middle|>": 100259,
+		"<|fim_suffix|>": 100260, "<|endofprompt|>": 100276},
+	//o200k_base
+	199998: {"<|endoftext|>": 199999, "<|endofprompt|>": 200018},
+}
+
+// byteLevelAlphabet is the GPT-2 mapping from bytes to printable characters.
+func byteLevelAlphabet() [256]rune {
+	var alphabet [256]rune
+	next := rune(256)
+	for b := 0; b < 256; b++ {
+		printable := (b >= '!' && b <= '~') || (b >= 0xA1 && b <= 0xAC) || (b >= 0xAE && b <= 0xFF)
+		if printable {
+			alphabet[b] = rune(b)
+		} else {
+			alphabet[b] = next
+			next++
+		}
+	}
+	return alphabet
+}
+
+// lookup resolves a token given as its text, special tokens included, or as
+// its id.
+func (t *bpeTokenizer) lookup(token string) (int, bool) {
+	if id, ok := t.special[token]; ok {
+		return id, true
+	}
+	if id, ok := t.vocab[token]; ok {
+		return id, true
+	}
+	if id, err := strconv.Atoi(token); err == nil && id >= 0 {
+		return id, true
+	}
+	return 0, false
+}
+
+// count returns the number of tokens in text.
+func (t *bpeTokenizer) count(text string) int {
+	count := 0
+	for _, piece := range t.pretokenize(text) {
+		count += len(t.encodePiece(piece))
+	}
+	return count
+}
+
+// encode converts text to token ids. Special tokens in the text are not
+// recognised, they are encoded as the plain text they consist of.
+func (t *bpeTokenizer) encode(text string) []int {
+	ids := []int{}
+	for _, piece := range t.pretokenize(text) {
+		ids = append(ids, t.encodePiece(piece)...)
+	}
+	return ids
+}
+
+// pretokenize splits text into the pieces that are encoded separately.
+func (t *bpeTokenizer) pretokenize(text string) []string {
+	pieces := []string{}
+	for pos := 0; pos < len(text); {
+		loc := t.pattern.FindStringIndex(text[pos:])
+		end := pos + 1
+		if loc != nil && loc[1] > 0 {
+			end = pos + loc[1]
+		}
+		piece := text[pos:end]
+		//a run of spaces leaves its last space to the word that follows it
+		if end < len(text) && len(piece) > 1 && strings.TrimSpace(piece) == "" && strings.HasSuffix(piece, " ") {
+			if r, _ := utf8.DecodeRuneInString(text[end:]); !unicode.IsSpace(r) {
+				piece = piece[:len(piece)-1]
+				end--
+			}
+		}
+		pieces = append(pieces, piece)
+		pos = end
+	}
+	return pieces
+}
+
+// encodePiece applies the BPE merges to a single pre-token.
+func (t *bpeTokenizer) encodePiece(piece string) []int {
+	if id, ok := t.vocab[piece]; ok {
+		return []int{id}
+	}
+	t.mu.Lock()
+	if ids, ok := t.cache[piece]; ok {
+		t.mu.Unlock()
+		return ids
+	}
+	t.mu.Unlock()
+
+	parts := make([]string, len(piece))
+	for i := range parts {
+		parts[i] = piece[i : i+1]
+	}
+	for len(parts) > 1 {
+		best, bestRank := -1, 0
+		for i := 0; i+1 < len(parts); i++ {
+			if rank, ok := t.pairRank(parts[i], parts[i+1]); ok && (best < 0 || rank < bestRank) {
+				best, bestRank = i, rank
+			}
+		}
+		if best < 0 {
+			break
+		}
+		parts[best] += parts[best+1]
+		parts = append(parts[:best+1], parts[best+2:]...)
+	}
+
+	ids := make([]int, 0, len(parts))
+	for _, part := range parts {
+		//bytes missing from the vocabulary still count as one token each
+		id, ok := t.vocab[part]
+		if !ok {
+			id = -1
+		}
+		ids = append(ids, id)
+	}
+
+	t.mu.Lock()
+	if len(t.cache) >= tokenizerCacheLimit {
+		t.cache = make(map[string][]int)
+	}
+	t.cache[piece] = ids
+	t.mu.Unlock()
+	return ids
+}
+
+// pairRank returns the merge priority of two adjacent parts, lower first.
+func (t *bpeTokenizer) pairRank(left, right string) (int, bool) {
+	if t.mergeRanks != nil {
+		rank, ok := t.mergeRanks[[2]string{left, right}]
+		return rank, ok
+	}
+	rank, ok := t.vocab[left+right]
+	return rank, ok
+}
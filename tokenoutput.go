@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// tokenIndexEntry locates one book in tokens.bin. Offset and length are in
+// tokens, the end-of-document token after each book is not included.
+type tokenIndexEntry struct {
+	File   string `json:"file"`
+	Title  string `json:"title"`
+	Author string `json:"author"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+}
+
+// tokenIndex is written to tokens.idx.json next to tokens.bin
+type tokenIndex struct {
+	Dtype     string            `json:"dtype"`
+	EOTToken  int               `json:"eotToken"`
+	Tokenizer string            `json:"tokenizer"`
+	Tokens    int64             `json:"tokens"`
+	Books     []tokenIndexEntry `json:"books"`
+}
+
+// tokenWriter appends tokenized books to a single flat binary file that can
+// be memory mapped as an array of dtype
+type tokenWriter struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	buf     *bufio.Writer
+	index   tokenIndex
+	written int64
+}
+
+// tokenDtype returns the smallest unsigned integer type that holds every
+// token id of the tokenizer.
+func tokenDtype(config programConfig) string {
+	if config.tokenizer.vocabSize <= 1<<16 && config.eotToken < 1<<16 {
+		return "uint16"
+	}
+	return "uint32"
+}
+
+func newTokenWriter(outputdir string, config programConfig) (*tokenWriter, error) {
+	path := filepath.Join(outputdir, "tokens.bin")
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &tokenWriter{
+		path: path,
+		file: file,
+		buf:  bufio.NewWriterSize(file, 1<<20),
+		index: tokenIndex{
+			Dtype:     tokenDtype(config),
+			EOTToken:  config.eotToken,
+			Tokenizer: filepath.Base(config.tokenizer.path),
+			Books:     []tokenIndexEntry{},
+		},
+	}, nil
+}
+
+// add appends a rendered book, as produced by renderTokens, and records its
+// position in the index.
+func (w *tokenWriter) add(file fileTrack, result *bookResult, tokens []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.buf.Write(tokens); err != nil {
+		return err
+	}
+	width := int64(2)
+	if w.index.Dtype == "uint32" {
+		width = 4
+	}
+	count := int64(len(tokens)) / width
+	w.index.Books = append(w.index.Books, tokenIndexEntry{
+		File:   file.name,
+		Title:  result.meta.title,
+		Author: result.meta.author,
+		Offset: w.written,
+		Length: count - 1,
+	})
+	w.written += count
+	return nil
+}
+
+// close flushes tokens.bin and writes tokens.idx.json.
+func (w *tokenWriter) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.index.Tokens = w.written
+	out, err := json.MarshalIndent(w.index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(w.path[:len(w.path)-len(".bin")]+".idx.json", out, 0644)
+}
+
+// renderTokens tokenizes a book and encodes it as little-endian token ids
+// followed by the end-of-document token.
+func renderTokens(result *bookResult, config programConfig) []byte {
+	ids := append(config.tokenizer.encode(result.text), config.eotToken)
+	width := 2
+	if tokenDtype(config) == "uint32" {
+		width = 4
+	}
+	out := make([]byte, 0, len(ids)*width)
+	for _, id := range ids {
+		//bytes missing from the vocabulary can't be represented, leave them out
+		if id < 0 {
+			continue
+		}
+		if width == 2 {
+			out = binary.LittleEndian.AppendUint16(out, uint16(id))
+		} else {
+			out = binary.LittleEndian.AppendUint32(out, uint32(id))
+		}
+	}
+	return out
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Typography policies, see applyTypography
+const (
+	typographyLegacy   = "legacy"
+	typographyPreserve = "preserve"
+	typographyASCII    = "ascii"
+	typographyNFKC     = "nfkc"
+)
+
+// invisibleReplacer removes characters that take no space and only get in
+// the way of matching words: soft hyphens, zero width spaces, word joiners,
+// byte order marks and invisible math operators. The zero width (non-)joiners
+// are kept, they change how Persian, Indic scripts and emoji are rendered.
+var invisibleReplacer = strings.NewReplacer(
+	"\u00ad", "", "\u200b", "", "\u2060", "", "\ufeff", "",
+	"\u2061", "", "\u2062", "", "\u2063", "", "\u2064", "",
+)
+
+// legacyReplacer replaces curly quotes and non-breaking spaces, the only
+// typographic characters the converter replaced before the policies existed
+var legacyReplacer = strings.NewReplacer("\u00a0", " ", "“", "\"", "”", "\"", "‘", "'", "’", "'")
+
+// asciiReplacer maps typographic quotes, dashes, ellipses and ligatures to
+// plain ASCII
+var asciiReplacer = strings.NewReplacer(
+	//quotes
+	"“", "\"", "”", "\"", "„", "\"", "‟", "\"", "«", "\"", "»", "\"", "″", "\"",
+	"‘", "'", "’", "'", "‚", "'", "‛", "'", "‹", "'", "›", "'", "′", "'",
+	//dashes
+	"‐", "-", "‑", "-", "‒", "-", "–", "-", "−", "-", "—", "--", "―", "--",
+	//ellipsis
+	"…", "...",
+	//ligatures
+	"ﬀ", "ff", "ﬁ", "fi", "ﬂ", "fl", "ﬃ", "ffi", "ﬄ", "ffl", "ﬅ", "st", "ﬆ", "st",
+	//line and paragraph separators
+	"\u2028", "\n", "\u2029", "\n",
+)
+
+// applyTypography normalizes typographic characters following the policy.
+// legacy only replaces curly quotes and non-breaking spaces. preserve keeps
+// the text as it is. ascii replaces quotes, dashes, ellipses,
+// ligatures and unusual spaces with plain ASCII and drops invisible
+// characters, letters are not changed. nfkc applies Unicode NFKC
+// normalization, which also folds ligatures, spaces and full-width forms but
+// keeps typographic quotes and dashes, and drops invisible characters.
+func applyTypography(input string, policy string) string {
+	switch policy {
+	case typographyLegacy:
+		return legacyReplacer.Replace(input)
+	case typographyASCII:
+		input = invisibleReplacer.Replace(input)
+		input = asciiReplacer.Replace(input)
+		return strings.Map(func(r rune) rune {
+			if r != ' ' && unicode.Is(unicode.Zs, r) {
+				return ' '
+			}
+			return r
+		}, input)
+	case typographyNFKC:
+		return norm.NFKC.String(invisibleReplacer.Replace(input))
+	}
+	return input
+}
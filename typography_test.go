@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestNormalizeTypography(t *testing.T) {
+	text := "“Wait—stop…” she said,\u00a0 ‘twas „ﬁne“ «non»\u00ad."
+	tests := []struct {
+		policy string
+		want   string
+	}{
+		//earlier versions only replaced curly quotes and non-breaking spaces,
+		//after collapsing double spaces
+		{typographyLegacy, "\"Wait—stop…\" she said,  'twas „ﬁne\" «non»\u00ad."},
+		{typographyPreserve, "“Wait—stop…” she said,\u00a0 ‘twas „ﬁne“ «non»\u00ad."},
+		{typographyASCII, "\"Wait--stop...\" she said, 'twas \"fine\" \"non\"."},
+		{typographyNFKC, "“Wait—stop...” she said, ‘twas „fine“ «non»."},
+	}
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			state := &cleanState{config: programConfig{typography: test.policy}}
+			if got := normalizeStage(text, state); got != test.want {
+				t.Errorf("normalizeStage(%q) = %q, want %q", text, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Severities of validation issues, from worst to least
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+	severityInfo    = "info"
+)
+
+// severityRanks orders the severities for -minSeverity
+var severityRanks = map[string]int{severityError: 3, severityWarning: 2, severityInfo: 1}
+
+// The checks of validateEpub
+const (
+	checkZip        = "zip"
+	checkMimetype   = "mimetype"
+	checkContainer  = "container"
+	checkPackage    = "package"
+	checkManifest   = "manifest"
+	checkSpine      = "spine"
+	checkResources  = "resources"
+	checkIDs        = "ids"
+	checkLinks      = "links"
+	checkXHTML      = "xhtml"
+	checkEncryption = "encryption"
+)
+
+// validationIssue is one problem found in a book
+type validationIssue struct {
+	Severity string `json:"severity"`
+	Check    string `json:"check"`
+	Path     string `json:"path,omitempty"`
+	Message  string `json:"message"`
+}
+
+// bookValidation is the report of one book
+type bookValidation struct {
+	Book     string            `json:"book"`
+	Errors   int               `json:"errors"`
+	Warnings int               `json:"warnings"`
+	Issues   []validationIssue `json:"issues"`
+}
+
+// validationSummary sums up the reports of a collection. Checks counts the
+// books with an error or warning per check.
+type validationSummary struct {
+	Books        int            `json:"books"`
+	Valid        int            `json:"valid"`
+	WithWarnings int            `json:"withWarnings"`
+	WithErrors   int            `json:"withErrors"`
+	Checks       map[string]int `json:"checks"`
+}
+
+// validationReport is written by -report
+type validationReport struct {
+	Summary validationSummary `json:"summary"`
+	Books   []bookValidation  `json:"books"`
+}
+
+// opfSchema holds the parts of the package document that are required
+type opfSchema struct {
+	Version          string `xml:"version,attr"`
+	UniqueIdentifier string `xml:"unique-identifier,attr"`
+	Identifiers      []struct {
+		ID string `xml:"id,attr"`
+	} `xml:"metadata>identifier"`
+	Titles    []string `xml:"metadata>title"`
+	Languages []string `xml:"metadata>language"`
+}
+
+// xhtmlDoc holds the ids and links of a content document, with the ids used
+// more than once
+type xhtmlDoc struct {
+	ids      map[string]bool
+	repeated map[string]int
+	links    []xhtmlLink
+}
+
+// xhtmlLink is a link of a content document to a file of the book. Resources
+// are needed to show the document, like images and stylesheets.
+type xhtmlLink struct {
+	href     string
+	resource bool
+}
+
+// runValidateCommand handles `validate <dir|file.epub>...`. It checks the
+// structure of every book without converting anything, prints a report per
+// book and a summary of the collection, and exits with status 1 when a book
+// has errors.
+func runValidateCommand(args []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s validate [options] <dir|file.epub>...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	reportPtr := fs.String("report", "",
+		"Writes the reports and the summary as json to this file. Defaults to none")
+	minSeverityPtr := fs.String("minSeverity", severityWarning,
+		"Least severity of the issues printed. Options: error, warning, info. Defaults to 'warning'")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	minRank, ok := severityRanks[*minSeverityPtr]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Error: minSeverity must be one of the following: error, warning, info")
+		os.Exit(2)
+	}
+
+	paths, err := findEpubs(fs.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(2)
+	}
+	report := validationReport{Summary: validationSummary{Checks: make(map[string]int)}, Books: []bookValidation{}}
+	for _, p := range paths {
+		book := validateEpubFile(p)
+		report.Books = append(report.Books, book)
+		report.Summary.add(book)
+		printBookValidation(book, minRank)
+	}
+	printValidationSummary(report.Summary)
+
+	if *reportPtr != "" {
+		out, err := json.MarshalIndent(report, "", "  ")
+		if err == nil {
+			err = os.WriteFile(*reportPtr, out, 0644)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error writing report:", err)
+			os.Exit(1)
+		}
+	}
+	if report.Summary.WithErrors > 0 {
+		os.Exit(1)
+	}
+}
+
+// findEpubs lists the epubs among the arguments, walking directories.
+func findEpubs(args []string) ([]string, error) {
+	paths := []string{}
+	for _, arg := range args {
+		err := filepath.Walk(arg, func(p string, info fs.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && (p == arg || strings.HasSuffix(info.Name(), ".epub")) {
+				paths = append(paths, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
+
+// add records an issue.
+func (v *bookValidation) add(severity string, check string, path string, format string, a ...interface{}) {
+	v.Issues = append(v.Issues, validationIssue{Severity: severity, Check: check, Path: path, Message: fmt.Sprintf(format, a...)})
+	switch severity {
+	case severityError:
+		v.Errors++
+	case severityWarning:
+		v.Warnings++
+	}
+}
+
+// add counts a book in the summary.
+func (s *validationSummary) add(book bookValidation) {
+	s.Books++
+	switch {
+	case book.Errors > 0:
+		s.WithErrors++
+	case book.Warnings > 0:
+		s.WithWarnings++
+	default:
+		s.Valid++
+	}
+	checks := make(map[string]bool)
+	for _, issue := range book.Issues {
+		if issue.Severity != severityInfo && !checks[issue.Check] {
+			checks[issue.Check] = true
+			s.Checks[issue.Check]++
+		}
+	}
+}
+
+// printBookValidation prints the report of a book, with the issues of at
+// least minRank.
+func printBookValidation(book bookValidation, minRank int) {
+	if book.Errors == 0 && book.Warnings == 0 {
+		fmt.Printf("%s: ok\n", book.Book)
+	} else {
+		fmt.Printf("%s: %d errors, %d warnings\n", book.Book, book.Errors, book.Warnings)
+	}
+	for _, issue := range book.Issues {
+		if severityRanks[issue.Severity] < minRank {
+			continue
+		}
+		location := ""
+		if issue.Path != "" {
+			location = issue.Path + ": "
+		}
+		fmt.Printf("  %-8s %-11s %s%s\n", issue.Severity, issue.Check, location, issue.Message)
+	}
+}
+
+// printValidationSummary prints the summary of a collection.
+func printValidationSummary(s validationSummary) {
+	fmt.Printf("--------------------\nChecked %d books: %d valid, %d with warnings, %d with errors.\n", s.Books, s.Valid, s.WithWarnings, s.WithErrors)
+	checks := make([]string, 0, len(s.Checks))
+	for check := range s.Checks {
+		checks = append(checks, check)
+	}
+	sort.Strings(checks)
+	for _, check := range checks {
+		fmt.Printf("  %-11s %d books\n", check, s.Checks[check])
+	}
+}
+
+// validateEpubFile checks the epub at path.
+func validateEpubFile(p string) bookValidation {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		book := bookValidation{Book: filepath.Base(p), Issues: []validationIssue{}}
+		book.add(severityError, checkZip, "", "can't be read: %s", err)
+		return book
+	}
+	return validateEpub(data, filepath.Base(p))
+}
+
+// validateEpub checks the structure of a book: the archive, container.xml,
+// the package document, the manifest and spine, the files they point to and
+// the content documents with their links.
+func validateEpub(data []byte, name string) bookValidation {
+	v := bookValidation{Book: name, Issues: []validationIssue{}}
+	z, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		v.add(severityError, checkZip, "", "not a valid zip archive: %s", err)
+		if z, err = recoverZip(data); err != nil {
+			return v
+		}
+		v.add(severityInfo, checkZip, "", "%d members read from the local file headers", len(z.File))
+	}
+	names := make(map[string]bool)
+	for _, f := range z.File {
+		if names[f.Name] {
+			v.add(severityWarning, checkZip, f.Name, "appears more than once in the archive")
+		}
+		names[f.Name] = true
+	}
+
+	switch mimetype, err := readZipFile(z, "mimetype"); {
+	case err != nil:
+		v.add(severityError, checkMimetype, "mimetype", "is missing")
+	case strings.TrimSpace(string(mimetype)) != "application/epub+zip":
+		v.add(severityError, checkMimetype, "mimetype", "is %q instead of \"application/epub+zip\"", strings.TrimSpace(string(mimetype)))
+	case z.File[0].Name != "mimetype" || z.File[0].Method != zip.Store:
+		v.add(severityWarning, checkMimetype, "mimetype", "isn't the first file of the archive, stored without compression")
+	}
+
+	opfPath := validateContainer(&v, z)
+	if opfPath == "" {
+		return v
+	}
+	opfData, _ := readZipFile(z, opfPath)
+	pkg := &opfPackage{}
+	schema := &opfSchema{}
+	if err := xml.Unmarshal(opfData, pkg); err != nil {
+		v.add(severityError, checkPackage, opfPath, "isn't well-formed: %s", err)
+		return v
+	}
+	xml.Unmarshal(opfData, schema)
+	validatePackage(&v, opfPath, pkg, schema)
+	docs := validateManifest(&v, z, opfPath, pkg)
+
+	if encrypted, err := encryptedContent(z, opfPath, pkg); err != nil {
+		v.add(severityError, checkEncryption, encryptionPath, "can't be read: %s", err)
+	} else if encrypted != "" {
+		v.add(severityError, checkEncryption, encrypted, "is encrypted, the book can't be converted")
+		return v
+	}
+	validateDocuments(&v, z, docs)
+	return v
+}
+
+// validateContainer checks container.xml and returns the path of the package
+// document, or "".
+func validateContainer(v *bookValidation, z *zip.Reader) string {
+	data, err := readZipFile(z, containerPath)
+	if err != nil {
+		v.add(severityError, checkContainer, containerPath, "is missing")
+		return ""
+	}
+	container := struct {
+		Rootfiles []struct {
+			FullPath string `xml:"full-path,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}{}
+	if err := xml.Unmarshal(data, &container); err != nil {
+		v.add(severityError, checkContainer, containerPath, "isn't well-formed: %s", err)
+		return ""
+	}
+	if len(container.Rootfiles) == 0 {
+		v.add(severityError, checkContainer, containerPath, "lists no package document")
+		return ""
+	}
+	opfPath := container.Rootfiles[0].FullPath
+	if _, err := z.Open(opfPath); err != nil {
+		v.add(severityError, checkContainer, containerPath, "points to %s, which is missing", opfPath)
+		return ""
+	}
+	return opfPath
+}
+
+// validatePackage checks the required metadata of the package document and
+// the consistency of its manifest and spine.
+func validatePackage(v *bookValidation, opfPath string, pkg *opfPackage, schema *opfSchema) {
+	if schema.Version == "" {
+		v.add(severityWarning, checkPackage, opfPath, "has no version")
+	}
+	if len(schema.Titles) == 0 || strings.TrimSpace(schema.Titles[0]) == "" {
+		v.add(severityError, checkPackage, opfPath, "has no dc:title")
+	}
+	if len(schema.Languages) == 0 || strings.TrimSpace(schema.Languages[0]) == "" {
+		v.add(severityError, checkPackage, opfPath, "has no dc:language")
+	}
+	uniqueIdentifier := false
+	for _, identifier := range schema.Identifiers {
+		uniqueIdentifier = uniqueIdentifier || identifier.ID == schema.UniqueIdentifier
+	}
+	switch {
+	case len(schema.Identifiers) == 0:
+		v.add(severityError, checkPackage, opfPath, "has no dc:identifier")
+	case !uniqueIdentifier:
+		v.add(severityError, checkPackage, opfPath, "unique-identifier %q matches no dc:identifier", schema.UniqueIdentifier)
+	}
+
+	ids := make(map[string]bool)
+	nav := false
+	for _, item := range pkg.Items {
+		if ids[item.ID] {
+			v.add(severityError, checkIDs, opfPath, "manifest id %q is used more than once", item.ID)
+		}
+		ids[item.ID] = true
+		nav = nav || hasWord(item.Properties, "nav")
+	}
+	if strings.HasPrefix(schema.Version, "3") && !nav {
+		v.add(severityWarning, checkManifest, opfPath, "has no navigation document, required by EPUB 3")
+	}
+
+	if len(pkg.Spine.Itemrefs) == 0 {
+		v.add(severityError, checkSpine, opfPath, "the spine is empty")
+	}
+	spined := make(map[string]bool)
+	for _, itemref := range pkg.Spine.Itemrefs {
+		switch {
+		case !ids[itemref.IDREF]:
+			v.add(severityError, checkSpine, opfPath, "itemref %q matches no manifest item", itemref.IDREF)
+		case spined[itemref.IDREF]:
+			v.add(severityWarning, checkSpine, opfPath, "itemref %q is in the spine more than once", itemref.IDREF)
+		}
+		spined[itemref.IDREF] = true
+	}
+	for _, item := range pkg.Items {
+		if spined[item.ID] && !contentMediaTypes[item.MediaType] {
+			v.add(severityWarning, checkSpine, opfPath, "item %q in the spine has media type %q", item.ID, item.MediaType)
+		}
+	}
+}
+
+// validateManifest checks that the files of the manifest are in the archive,
+// and the other way around, and returns the paths of the content documents.
+func validateManifest(v *bookValidation, z *zip.Reader, opfPath string, pkg *opfPackage) map[string]string {
+	docs := make(map[string]string)
+	listed := map[string]bool{"mimetype": true, opfPath: true}
+	for _, item := range pkg.Items {
+		itemPath, _ := resolveHREF(opfPath, item.HREF)
+		listed[itemPath] = true
+		if _, err := z.Open(itemPath); err != nil {
+			v.add(severityError, checkResources, itemPath, "is in the manifest as %q but missing from the archive", item.ID)
+			continue
+		}
+		if contentMediaTypes[item.MediaType] {
+			docs[itemPath] = item.MediaType
+		}
+	}
+	for _, f := range z.File {
+		if !listed[f.Name] && !strings.HasPrefix(f.Name, "META-INF/") && !strings.HasSuffix(f.Name, "/") {
+			v.add(severityInfo, checkResources, f.Name, "isn't in the manifest")
+		}
+	}
+	return docs
+}
+
+// validateDocuments checks that the XHTML content documents are well-formed,
+// that their ids are unique and that their links point to files and ids of
+// the book.
+func validateDocuments(v *bookValidation, z *zip.Reader, docs map[string]string) {
+	paths := make([]string, 0, len(docs))
+	for p := range docs {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	parsed := make(map[string]*xhtmlDoc)
+	for _, p := range paths {
+		data, err := readZipFile(z, p)
+		if err != nil {
+			v.add(severityError, checkZip, p, "can't be read: %s", err)
+			continue
+		}
+		data, _ = decodeDocument(data)
+		doc, err := readXHTML(data)
+		if err != nil && docs[p] == "application/xhtml+xml" {
+			v.add(severityError, checkXHTML, p, "isn't well-formed: %s", err)
+		}
+		for id, n := range doc.repeated {
+			v.add(severityWarning, checkIDs, p, "id %q is used %d times", id, n)
+		}
+		parsed[p] = doc
+	}
+
+	for _, p := range paths {
+		doc := parsed[p]
+		if doc == nil {
+			continue
+		}
+		for _, link := range doc.links {
+			target, fragment := resolveHREF(p, link.href)
+			if _, err := z.Open(target); err != nil {
+				severity := severityWarning
+				if link.resource {
+					severity = severityError
+				}
+				v.add(severity, checkLinks, p, "links to %s, which is missing", link.href)
+				continue
+			}
+			if targetDoc := parsed[target]; fragment != "" && targetDoc != nil && !targetDoc.ids[fragment] {
+				v.add(severityWarning, checkLinks, p, "links to %s, which has no id %q", link.href, fragment)
+			}
+		}
+	}
+}
+
+// readXHTML reads the ids and internal links of a content document. It
+// returns what it read up to the first error, so links of documents that
+// aren't well-formed are still checked. The named entities of HTML are
+// allowed, XHTML declares them in its DTD.
+func readXHTML(data []byte) (*xhtmlDoc, error) {
+	doc := &xhtmlDoc{ids: make(map[string]bool)}
+	counts := make(map[string]int)
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Entity = xml.HTMLEntity
+	//decodeDocument already transcoded the document to UTF-8
+	decoder.CharsetReader = func(label string, input io.Reader) (io.Reader, error) { return input, nil }
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			doc.countIDs(counts)
+			return doc, err
+		}
+		element, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		for _, a := range element.Attr {
+			switch {
+			case a.Name.Local == "id":
+				counts[a.Value]++
+			case a.Name.Local == "href" && element.Name.Local != "base":
+				resource := element.Name.Local == "link" || element.Name.Local == "image"
+				doc.addLink(a.Value, resource)
+			case a.Name.Local == "src":
+				doc.addLink(a.Value, true)
+			}
+		}
+	}
+	doc.countIDs(counts)
+	return doc, nil
+}
+
+// addLink adds a link unless it points outside the book.
+func (doc *xhtmlDoc) addLink(href string, resource bool) {
+	href = strings.TrimSpace(href)
+	if u, err := url.Parse(href); href == "" || err != nil || u.Scheme != "" || u.Host != "" || path.IsAbs(u.Path) {
+		return
+	}
+	doc.links = append(doc.links, xhtmlLink{href: href, resource: resource})
+}
+
+// countIDs keeps the ids counted while reading the document, with the counts
+// of the ids used more than once.
+func (doc *xhtmlDoc) countIDs(counts map[string]int) {
+	for id, n := range counts {
+		doc.ids[id] = true
+		if n > 1 {
+			if doc.repeated == nil {
+				doc.repeated = make(map[string]int)
+			}
+			doc.repeated[id] = n
+		}
+	}
+}
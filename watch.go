@@ -0,0 +1,307 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// watchOp is the kind of change reported for a watched path
+type watchOp int
+
+const (
+	watchWritten watchOp = iota
+	watchRemoved
+	watchOverflow
+)
+
+// watchEvent is a change to a file or directory under the input directory
+type watchEvent struct {
+	path  string
+	isDir bool
+	op    watchOp
+}
+
+// dirWatcher reports changes in a set of directories. The implementation is
+// platform specific, see watch_linux.go.
+type dirWatcher interface {
+	Add(dir string) error
+	Events() <-chan watchEvent
+	Errors() <-chan error
+}
+
+// pendingBook is an epub that changed and is waiting for writes to settle
+type pendingBook struct {
+	lastEvent time.Time
+	size      int64
+}
+
+// bookWatcher keeps the output directory in sync with the input directory
+type bookWatcher struct {
+	inputdir  string
+	outputdir string
+	config    programConfig
+	flags     *configFlags
+	counters  *programCounter
+	debounce  time.Duration
+	outputs   map[string][]string
+	pending   map[string]pendingBook
+	watcher   dirWatcher
+}
+
+// watchInputDir watches the input directory after the initial conversion and
+// converts epubs as they are added or changed, removing the outputs of epubs
+// that are deleted. outputs holds the files written by the initial run, and
+// flags the options the files of config were loaded from. It returns when the
+// process is interrupted.
+func watchInputDir(inputdir string, outputdir string, config programConfig, flags *configFlags, counters *programCounter, outputs map[string][]string, debounce time.Duration) error {
+	watcher, err := newDirWatcher()
+	if err != nil {
+		return err
+	}
+	w := &bookWatcher{
+		inputdir:  inputdir,
+		outputdir: outputdir,
+		config:    config,
+		flags:     flags,
+		counters:  counters,
+		debounce:  debounce,
+		outputs:   outputs,
+		pending:   make(map[string]pendingBook),
+		watcher:   watcher,
+	}
+	if err := w.addTree(inputdir, false); err != nil {
+		return err
+	}
+	logf("Watching %s for changes\n", inputdir)
+
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	ticker := time.NewTicker(watchTick(debounce))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event := <-watcher.Events():
+			w.handleEvent(event)
+		case err := <-watcher.Errors():
+			logf("Watch error: %s\n", err)
+		case <-ticker.C:
+			w.convertSettled()
+		case <-interrupted:
+			if counters.charCount > 0 {
+				printSummary(counters)
+			}
+			return nil
+		}
+	}
+}
+
+// minWatchTick is the shortest interval at which pending books are checked
+const minWatchTick = 10 * time.Millisecond
+
+// watchTick returns how often pending books are checked: a quarter of the
+// debounce period, but no less than minWatchTick, so a debounce of 0 converts
+// books as soon as they are written without busy looping.
+func watchTick(debounce time.Duration) time.Duration {
+	if tick := debounce / 4; tick > minWatchTick {
+		return tick
+	}
+	return minWatchTick
+}
+
+// addTree watches dir and everything below it. When schedule is set the epubs
+// found are queued for conversion, which catches books that arrive together
+// with a new directory.
+func (w *bookWatcher) addTree(dir string, schedule bool) error {
+	return filepath.Walk(dir, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			//the directory may have been removed again while walking it
+			return nil
+		}
+		if info.IsDir() {
+			return w.watcher.Add(path)
+		}
+		if schedule && strings.HasSuffix(info.Name(), ".epub") {
+			w.schedule(path)
+		}
+		return nil
+	})
+}
+
+// handleEvent reacts to a single change in the input directory.
+func (w *bookWatcher) handleEvent(event watchEvent) {
+	switch {
+	case event.op == watchOverflow:
+		w.rescan()
+	case event.isDir && event.op == watchWritten:
+		if err := w.addTree(event.path, true); err != nil {
+			logf("Could not watch %s: %s\n", event.path, err)
+		}
+	case event.isDir && event.op == watchRemoved:
+		prefix := event.path + string(filepath.Separator)
+		for source := range w.outputs {
+			if strings.HasPrefix(source, prefix) {
+				w.forget(source)
+			}
+		}
+		for source := range w.pending {
+			if strings.HasPrefix(source, prefix) {
+				delete(w.pending, source)
+			}
+		}
+	case !strings.HasSuffix(event.path, ".epub"):
+		return
+	case event.op == watchWritten:
+		w.schedule(event.path)
+	case event.op == watchRemoved:
+		delete(w.pending, event.path)
+		w.forget(event.path)
+	}
+}
+
+// schedule queues an epub for conversion once it stops changing.
+func (w *bookWatcher) schedule(path string) {
+	size := int64(-1)
+	if info, err := os.Stat(path); err == nil {
+		size = info.Size()
+	}
+	w.pending[path] = pendingBook{lastEvent: time.Now(), size: size}
+}
+
+// rescan catches up after the kernel dropped events: new epubs are queued and
+// outputs of epubs that disappeared are removed.
+func (w *bookWatcher) rescan() {
+	logf("Too many changes at once, rescanning %s\n", w.inputdir)
+	w.addTree(w.inputdir, false)
+	filepath.Walk(w.inputdir, func(path string, info fs.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && strings.HasSuffix(info.Name(), ".epub") {
+			if _, ok := w.outputs[path]; !ok {
+				w.schedule(path)
+			}
+		}
+		return nil
+	})
+	for source := range w.outputs {
+		if _, err := os.Stat(source); os.IsNotExist(err) {
+			w.forget(source)
+		}
+	}
+}
+
+// convertSettled converts the pending epubs that have not changed for the
+// debounce period and whose size is stable, so partially written files are
+// left alone.
+func (w *bookWatcher) convertSettled() {
+	now := time.Now()
+	for path, book := range w.pending {
+		if now.Sub(book.lastEvent) < w.debounce {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			delete(w.pending, path)
+			continue
+		}
+		if info.Size() != book.size {
+			w.pending[path] = pendingBook{lastEvent: now, size: info.Size()}
+			continue
+		}
+		delete(w.pending, path)
+		w.convert(path)
+	}
+}
+
+// convert converts a single epub and replaces its previous outputs.
+func (w *bookWatcher) convert(path string) {
+	file := fileTrack{name: filepath.Base(path), path: path, isEpub: true}
+	w.counters.bookCount++
+	//pick up edits of the rules, word list and tokenizer files
+	if err := w.flags.loadFiles(&w.config); err != nil {
+		logf("Could not reload the option files, keeping the loaded ones: %s\n", err)
+	}
+	if w.config.dedup != nil {
+		//a changed book would otherwise duplicate its earlier version
+		w.config.dedup.remove(path)
+		defer w.writeDedupReport()
+	}
+	result, err := convertEpubFile(file, w.config, w.counters)
+	if err != nil {
+		//most likely still being written, the next change will queue it again
+		logf("Could not convert %s: %s\n", path, err)
+		return
+	}
+	if result.skipReason != "" {
+		w.removeOutputs(path)
+		return
+	}
+
+	written, err := writeBookOutput(file, result, w.outputdir, w.config)
+	if err != nil {
+		logf("Could not write %s: %s\n", path, err)
+		return
+	}
+	w.counters.finishedBooksCount++
+
+	//the output path depends on the metadata, so a replaced book may move
+	for _, old := range w.outputs[path] {
+		if !containsString(written, old) {
+			w.removeFile(old)
+		}
+	}
+	w.outputs[path] = written
+}
+
+// forget removes the outputs of an epub that was deleted, and drops it from
+// the dedup report.
+func (w *bookWatcher) forget(source string) {
+	w.removeOutputs(source)
+	if w.config.dedup != nil {
+		w.config.dedup.remove(source)
+		w.writeDedupReport()
+	}
+}
+
+// writeDedupReport rewrites dedup-report.json after a change.
+func (w *bookWatcher) writeDedupReport() {
+	if err := w.config.dedup.writeReport(w.outputdir); err != nil {
+		logf("Could not write dedup report: %s\n", err)
+	}
+}
+
+// removeOutputs deletes the files written for an epub.
+func (w *bookWatcher) removeOutputs(source string) {
+	for _, output := range w.outputs[source] {
+		w.removeFile(output)
+	}
+	delete(w.outputs, source)
+}
+
+// removeFile deletes an output file and any folders left empty by it.
+func (w *bookWatcher) removeFile(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		logf("Could not remove %s: %s\n", path, err)
+		return
+	}
+	logf("Removed %s\n", path)
+	root := filepath.Clean(w.outputdir)
+	for dir := filepath.Dir(path); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		//fails once a folder still has other books in it
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// inotifyMask is the set of changes we are told about for each directory
+const inotifyMask = syscall.IN_CREATE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE |
+	syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_DELETE
+
+// inotifyWatcher is a dirWatcher backed by linux inotify
+type inotifyWatcher struct {
+	fd     int
+	mu     sync.Mutex
+	dirs   map[int]string
+	events chan watchEvent
+	errors chan error
+}
+
+func newDirWatcher() (dirWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("inotify: %w", err)
+	}
+	w := &inotifyWatcher{
+		fd:     fd,
+		dirs:   make(map[int]string),
+		events: make(chan watchEvent, 256),
+		errors: make(chan error, 1),
+	}
+	go w.readEvents()
+	return w, nil
+}
+
+// Add starts watching a single directory. Adding a directory twice is fine.
+func (w *inotifyWatcher) Add(dir string) error {
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, inotifyMask)
+	if err != nil {
+		return fmt.Errorf("inotify watch %s: %w", dir, err)
+	}
+	w.mu.Lock()
+	w.dirs[wd] = dir
+	w.mu.Unlock()
+	return nil
+}
+
+func (w *inotifyWatcher) Events() <-chan watchEvent { return w.events }
+
+func (w *inotifyWatcher) Errors() <-chan error { return w.errors }
+
+// readEvents decodes the raw inotify records and forwards them as watchEvents.
+func (w *inotifyWatcher) readEvents() {
+	var buf [64 * (syscall.SizeofInotifyEvent + syscall.NAME_MAX + 1)]byte
+	for {
+		n, err := syscall.Read(w.fd, buf[:])
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			w.errors <- fmt.Errorf("inotify read: %w", err)
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := string(bytes.TrimRight(buf[nameStart:nameStart+int(raw.Len)], "\x00"))
+			offset = nameStart + int(raw.Len)
+
+			if raw.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				w.events <- watchEvent{op: watchOverflow}
+				continue
+			}
+			w.mu.Lock()
+			dir, ok := w.dirs[int(raw.Wd)]
+			if raw.Mask&syscall.IN_IGNORED != 0 {
+				delete(w.dirs, int(raw.Wd))
+			}
+			w.mu.Unlock()
+			if !ok || name == "" {
+				continue
+			}
+
+			event := watchEvent{
+				path:  filepath.Join(dir, name),
+				isDir: raw.Mask&syscall.IN_ISDIR != 0,
+				op:    watchWritten,
+			}
+			if raw.Mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0 {
+				event.op = watchRemoved
+			}
+			w.events <- event
+		}
+	}
+}